@@ -0,0 +1,274 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Implemented by transports that can look up many keys in one request
+type BatchFinder interface {
+	// Finds the next n successors of each key, in the order of the keys
+	FindSuccessorsBatch(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error)
+}
+
+// Largest number of keys sent in one batch request
+const maxLookupBatch = 1024
+
+// Returned by LookupMany when some of the keys could not be looked up, the
+// results of the other keys are returned with it
+type LookupManyError struct {
+	Errs []error // Error of each key in the order of the keys, nil for the keys that were found
+}
+
+func (e *LookupManyError) Error() string {
+	var first error
+	failed := 0
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d lookups failed, the first with: %s", failed, len(e.Errs), first)
+}
+
+// Returns the errors of the keys that failed
+func (e *LookupManyError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// RPC: Finds the next N successors of each key. Keys we are the predecessor
+// of are answered directly, the others are grouped by their closest preceding
+// node and forwarded as one batch per next hop. Keys whose batch fails fall
+// back to a FindSuccessors of their own, which tries the other candidates,
+// and keys that fail too are answered with an empty list.
+func (vn *localVnode) FindSuccessorsBatch(n int, keys [][]byte) ([][]*Vnode, error) {
+	n = vn.clampSuccessors(n)
+	results := make([][]*Vnode, len(keys))
+	var hops []*Vnode
+	groups := make(map[string][]int)
+	var single []int
+	for i, key := range keys {
+		// Check if we are the immediate predecessor
+		succ := vn.successors[0]
+		if bytes.Compare(key, vn.Id) == 0 || succ == nil || global.BetweenRightIncl(vn.Id, succ.Id, key) {
+			results[i] = append([]*Vnode(nil), vn.successors[:n]...)
+			continue
+		}
+
+		// Group by the closest preceding node
+		cp := closestPreceedingVnodeIterator{}
+		cp.init(vn, key)
+		hop, _ := cp.Next()
+		if hop == nil {
+			single = append(single, i)
+			continue
+		}
+		if _, ok := groups[hop.String()]; !ok {
+			hops = append(hops, hop)
+		}
+		groups[hop.String()] = append(groups[hop.String()], i)
+	}
+
+	// Without batch support every key is looked up on its own
+	finder, ok := vn.ring.transport.(BatchFinder)
+	if !ok {
+		for _, hop := range hops {
+			single = append(single, groups[hop.String()]...)
+		}
+		hops = nil
+	}
+
+	// Forward a batch to each next hop in parallel
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, hop := range hops {
+		idx := groups[hop.String()]
+		for len(idx) > 0 {
+			chunk := idx
+			if len(chunk) > maxLookupBatch {
+				chunk = chunk[:maxLookupBatch]
+			}
+			idx = idx[len(chunk):]
+			wg.Add(1)
+			go func(hop *Vnode, chunk []int) {
+				defer wg.Done()
+				batch := make([][]byte, len(chunk))
+				for j, i := range chunk {
+					batch[j] = keys[i]
+				}
+				res, err := finder.FindSuccessorsBatch(hop, n, batch)
+				if err == nil && len(res) != len(chunk) {
+					err = fmt.Errorf("Got %d results for %d keys", len(res), len(chunk))
+				}
+				if err != nil {
+					log.Printf("[ERR] Failed to contact %s. Got %s", hop.String(), err)
+					lock.Lock()
+					single = append(single, chunk...)
+					lock.Unlock()
+					return
+				}
+				for j, i := range chunk {
+					results[i] = res[j]
+				}
+			}(hop, chunk)
+		}
+	}
+	wg.Wait()
+
+	// Look up the rest one at a time
+	for _, i := range single {
+		res, _, _, err := vn.FindSuccessors(n, keys[i])
+		if err != nil {
+			log.Printf("[ERR] Failed to look up a key of the batch. Got %s", err)
+			continue
+		}
+		results[i] = res
+	}
+	return results, nil
+}
+
+// Looks up a batch of keys on a local vnode, or passes the request on
+func (lt *LocalTransport) FindSuccessorsBatch(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		local, ok := obj.(*localVnode)
+		if !ok {
+			return nil, fmt.Errorf("Vnode %s does not support batch lookups", vn.String())
+		}
+		res, err := local.FindSuccessorsBatch(n, keys)
+		reqBytes := vnodeSize(vn) + 8
+		for _, key := range keys {
+			reqBytes += 4 + len(key)
+		}
+		respBytes := 4
+		for _, succs := range res {
+			respBytes += vnodesSize(succs)
+		}
+		lt.stats.record(rpcFindSuccessorsBatch, reqBytes, respBytes)
+		return res, err
+	}
+
+	// Pass onto remote
+	if remote, ok := lt.remote.(BatchFinder); ok {
+		return remote.FindSuccessorsBatch(vn, n, keys)
+	}
+	return nil, fmt.Errorf("Transport does not support batch lookups")
+}
+
+// Looks up a batch of keys on a remote vnode
+func (t *TCPTransport) FindSuccessorsBatch(vn *Vnode, n int, keys [][]byte) ([][]*Vnode, error) {
+	body, err := t.call(vn.Host, tcpFindSucBatchReq, &tcpBodyFindSucBatch{Target: vn, Num: n, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := body.(*tcpBodyVnodeListsError)
+	if !ok {
+		return nil, unexpectedResponse(tcpFindSucBatchReq, body)
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Lists, nil
+}
+
+/*
+	Does a key lookup for up to N successors of each of the keys, in the order
+	of the keys. With recursive lookups the hashed keys are sorted and grouped
+	by the nearest local vnode, which forwards them in batches, one per next
+	hop, so resolving many keys takes far fewer round trips than a Lookup per
+	key. Keys the batches did not resolve are retried on their own, and with
+	iterative lookups every key is looked up on its own. Results are cached
+	and verified as by Lookup, and N may exceed NumSuccessors. Keys that still
+	fail are left nil and reported in a LookupManyError.
+*/
+func (r *Ring) LookupMany(n int, keys [][]byte) ([][]*Vnode, error) {
+	results := make([][]*Vnode, len(keys))
+	errs := make([]error, len(keys))
+	hashes := make([][]byte, len(keys))
+	for i, key := range keys {
+		hashes[i] = r.hashKey(key)
+	}
+	mode := r.config.LookupMode
+	if mode == IterativeLookup {
+		for i := range keys {
+			results[i], errs[i] = r.lookupID(mode, n, hashes[i])
+		}
+		return results, lookupManyError(errs)
+	}
+
+	// Answer hot keys from the location cache
+	k := r.lookupSize(n)
+	var order []int
+	for i := range keys {
+		if successors, ok := r.cache.get(n, hashes[i], r.knownDead); ok {
+			results[i] = r.finishLookup(n, k, hashes[i], successors, true)
+			continue
+		}
+		order = append(order, i)
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(hashes[order[a]], hashes[order[b]]) < 0
+	})
+
+	// Sorted keys with the same nearest vnode are adjacent
+	vnodes := r.localVnodes()
+	for len(order) > 0 {
+		nearest := nearestIn(vnodes, hashes[order[0]])
+		end := 1
+		for end < len(order) && nearestIn(vnodes, hashes[order[end]]) == nearest {
+			end++
+		}
+		group := order[:end]
+		order = order[end:]
+
+		batch := make([][]byte, len(group))
+		for j, i := range group {
+			batch[j] = hashes[i]
+		}
+		res, err := nearest.FindSuccessorsBatch(k, batch)
+		if err != nil {
+			log.Printf("[ERR] Batch lookup failed. Got %s", err)
+		}
+		for j, i := range group {
+			var successors []*Vnode
+			if err == nil {
+				successors = res[j]
+			}
+
+			// Retry the keys the batch did not resolve
+			if len(successors) == 0 || successors[0] == nil {
+				if successors, errs[i] = r.retryLookup(mode, k, hashes[i]); errs[i] != nil {
+					continue
+				}
+			}
+			results[i] = r.finishLookup(n, k, hashes[i], successors, false)
+		}
+	}
+	return results, lookupManyError(errs)
+}
+
+// Returns a LookupManyError if any of the keys failed, nil otherwise
+func lookupManyError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &LookupManyError{Errs: errs}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ahrtr/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+hostBreaker is a circuit breaker guarding the calls to a single remote host.
+While closed every call goes through. After threshold consecutive failures it
+opens, and calls fail fast with ErrHostUnavailable instead of paying the dial
+or RPC timeout again. Once the backoff has passed the breaker is half open and
+lets a single probe call through: if it succeeds the breaker closes, otherwise
+it opens again with the backoff doubled, up to a maximum.
+*/
+type hostBreaker struct {
+	state    breakerState
+	failures int           // Consecutive failures while closed
+	backoff  time.Duration // Time to stay open before probing
+	openedAt time.Time
+	probing  bool // Set while the half open probe is in flight
+	stats    BreakerStats
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("breakerState(%d)", int(s))
+}
+
+// Default breaker policy
+const (
+	defaultBreakerThreshold  = 3
+	defaultBreakerBackoff    = time.Second
+	defaultBreakerMaxBackoff = time.Minute
+)
+
+// State and counters of the circuit breaker of a host
+type BreakerStats struct {
+	State    string        // closed, open or half-open
+	Backoff  time.Duration // Current backoff before the next probe
+	Failures uint64        // Calls that failed to reach the host
+	Trips    uint64        // Times the breaker opened
+	Rejected uint64        // Calls failed fast while the breaker was open
+}
+
+// Implemented by transports that keep per host circuit breakers
+type BreakerStatsProvider interface {
+	// Returns a copy of the breaker state, keyed by host
+	BreakerStats() map[string]BreakerStats
+}
+
+// Sets the circuit breaker policy: the consecutive failures that open the
+// breaker of a host, and the initial and maximum backoff before probing it
+func (t *TCPTransport) SetBreakerPolicy(threshold int, backoff, maxBackoff time.Duration) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+	t.breakerThreshold = threshold
+	t.breakerBackoff = backoff
+	t.breakerMaxBackoff = maxBackoff
+}
+
+// Checks whether a call to the host may go through
+func (t *TCPTransport) breakerAllow(host string) error {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.backoff {
+			break
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+	b.stats.Rejected++
+	return fmt.Errorf("%w Circuit breaker of %s is %s", ErrHostUnavailable, host, b.state)
+}
+
+// Records the outcome of a call that was allowed through. Only failures to
+// reach the host count, errors returned by the remote vnode do not.
+func (t *TCPTransport) breakerRecord(host string, err error) {
+	failed := err != nil && isUnreachable(err)
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		if !failed {
+			return
+		}
+		b = &hostBreaker{backoff: t.breakerBackoff}
+		t.breakers[host] = b
+	}
+	b.probing = false
+
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		b.backoff = t.breakerBackoff
+		return
+	}
+
+	b.stats.Failures++
+	switch b.state {
+	case breakerClosed:
+		b.failures++
+		if b.failures < t.breakerThreshold {
+			return
+		}
+	case breakerHalfOpen:
+		b.backoff *= 2
+		if b.backoff > t.breakerMaxBackoff {
+			b.backoff = t.breakerMaxBackoff
+		}
+	}
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.stats.Trips++
+}
+
+// Reports whether an error means the host could not be reached
+func isUnreachable(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	var opErr *net.OpError
+	return errors.As(err, &netErr) || errors.As(err, &opErr)
+}
+
+// Returns a copy of the breaker state of every host that has failed
+func (t *TCPTransport) BreakerStats() map[string]BreakerStats {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+	res := make(map[string]BreakerStats, len(t.breakers))
+	for host, b := range t.breakers {
+		s := b.stats
+		s.State = b.state.String()
+		s.Backoff = b.backoff
+		res[host] = s
+	}
+	return res
+}
+
+// Returns the breaker state of the remote transport, if it keeps any
+func (lt *LocalTransport) BreakerStats() map[string]BreakerStats {
+	if remote, ok := lt.remote.(BreakerStatsProvider); ok {
+		return remote.BreakerStats()
+	}
+	return make(map[string]BreakerStats)
+}
+
+// Returns the circuit breaker state of the transport, keyed by host
+func (r *Ring) BreakerStats() map[string]BreakerStats {
+	if provider, ok := r.transport.(BreakerStatsProvider); ok {
+		return provider.BreakerStats()
+	}
+	return make(map[string]BreakerStats)
+}
+
+/*
+	Logs the circuit breaker state of each remote host to breakerPerformance.csv
+	1. State: closed, open or half-open at the end of the run
+	2. Backoff: Current backoff before the breaker probes the host again
+	3. Failures: Calls that failed to reach the host
+	4. Trips: Number of times the breaker opened
+	5. Rejected: Calls failed fast without contacting the host
+*/
+func LogBreakerStats(stats map[string]BreakerStats) {
+	var breakerHeader []string
+	breakerHeader = append(breakerHeader, "Host")
+	breakerHeader = append(breakerHeader, "State")
+	breakerHeader = append(breakerHeader, "Backoff")
+	breakerHeader = append(breakerHeader, "Failures")
+	breakerHeader = append(breakerHeader, "Trips")
+	breakerHeader = append(breakerHeader, "Rejected")
+
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var breakerData [][]string
+	for _, host := range hosts {
+		s := stats[host]
+		var data []string
+		data = append(data, host)
+		data = append(data, s.State)
+		data = append(data, s.Backoff.String())
+		data = append(data, strconv.FormatUint(s.Failures, 10))
+		data = append(data, strconv.FormatUint(s.Trips, 10))
+		data = append(data, strconv.FormatUint(s.Rejected, 10))
+		breakerData = append(breakerData, data)
+	}
+
+	if err := writeCSV("breakerPerformance.csv", breakerHeader, breakerData); err != nil {
+		logrus.Errorln("Unable to write breaker performance:", err.Error())
+	}
+}
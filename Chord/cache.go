@@ -0,0 +1,297 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+locationCache remembers which vnode owns a range of keys, learned from the
+results of previous lookups, so repeated lookups of hot keys do not walk the
+ring. An entry maps the keys in (start, owner] to the owner and the successors
+following it. Consecutive successors in a lookup result give exact ranges, the
+first one is only known to own the keys from the looked up key onwards. Results
+are learned by the vnode that started a lookup and by every vnode it passed.
+
+Entries are dropped when their owner fails or leaves, and when a vnode inside
+their range is learned of, since it now owns part of the range. Vnodes can join
+without any of that being noticed, so entries also expire after the TTL. When
+full the least recently used entry is evicted.
+*/
+type locationCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries []*cacheEntry // Sorted by owner ID
+	tick    uint64
+	stats   LocationCacheStats
+}
+
+// Keys in (start, owner] are owned by succs[0]
+type cacheEntry struct {
+	start   []byte
+	succs   []*Vnode
+	used    uint64
+	learned time.Time
+}
+
+// Hit rate and eviction counters of the location cache
+type LocationCacheStats struct {
+	Size          int    // Entries currently cached
+	Hits          uint64 // Lookups answered from the cache
+	Misses        uint64 // Lookups that walked the ring
+	Evictions     uint64 // Entries dropped to stay within the size bound
+	Invalidations uint64 // Entries dropped because their owner failed or disowned keys
+	Expirations   uint64 // Entries dropped because they outlived the TTL
+}
+
+// Returns the share of lookups answered from the cache
+func (s LocationCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Creates a cache of at most size entries that expire after the TTL, nil if
+// size is not positive
+func newLocationCache(size int, ttl time.Duration) *locationCache {
+	if size <= 0 {
+		return nil
+	}
+	return &locationCache{size: size, ttl: ttl}
+}
+
+// Returns whether an entry outlived the TTL
+func (c *locationCache) expired(e *cacheEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(e.learned) > c.ttl
+}
+
+// Returns the index of the entry whose range would hold the key
+func (c *locationCache) search(key []byte) int {
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return bytes.Compare(c.entries[i].succs[0].Id, key) >= 0
+	})
+	if i == len(c.entries) {
+		i = 0
+	}
+	return i
+}
+
+// Returns up to n cached successors of a key. Entries that expired or whose
+// owner is known to be dead are dropped instead.
+func (c *locationCache) get(n int, key []byte, dead func(vn *Vnode) bool) ([]*Vnode, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) > 0 {
+		i := c.search(key)
+		e := c.entries[i]
+		if global.BetweenRightIncl(e.start, e.succs[0].Id, key) && c.expired(e, time.Now()) {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			c.stats.Expirations++
+		} else if global.BetweenRightIncl(e.start, e.succs[0].Id, key) && dead(e.succs[0]) {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			c.stats.Invalidations++
+		} else if len(e.succs) >= n && global.BetweenRightIncl(e.start, e.succs[0].Id, key) {
+			c.tick++
+			e.used = c.tick
+			c.stats.Hits++
+			res := make([]*Vnode, n)
+			copy(res, e.succs)
+			return res, true
+		}
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Learns the successors of a key from a lookup result. Pred is the vnode that
+// answered the lookup, the predecessor of the first successor, or nil if it
+// is not known.
+func (c *locationCache) learn(key []byte, pred *Vnode, succs []*Vnode, bits int) {
+	if c == nil || len(succs) == 0 {
+		return
+	}
+	start := previousId(key, bits)
+	if pred != nil {
+		start = pred.Id
+	}
+	succs = append([]*Vnode(nil), succs...)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, s := range succs {
+		if s == nil {
+			break
+		}
+		if i > 0 {
+			start = succs[i-1].Id
+		}
+		c.insert(start, succs[i:])
+	}
+}
+
+// Adds an entry, dropping the entries it contradicts
+func (c *locationCache) insert(start []byte, succs []*Vnode) {
+	owner := succs[0]
+	if bytes.Equal(start, owner.Id) {
+		return
+	}
+	now := time.Now()
+	kept := c.entries[:0]
+	for _, e := range c.entries {
+		if c.expired(e, now) {
+			c.stats.Expirations++
+			continue
+		}
+
+		// Keep the wider range known for the same owner
+		eOwner := e.succs[0].Id
+		if bytes.Equal(eOwner, owner.Id) {
+			if global.Between(e.start, owner.Id, start) {
+				start = e.start
+			}
+			continue
+		}
+
+		// Owners inside each other's range cannot both be right, the newer wins
+		if global.Between(start, owner.Id, eOwner) ||
+			global.Between(e.start, eOwner, owner.Id) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	c.entries = kept
+
+	// Make room for the entry
+	if len(c.entries) >= c.size {
+		lru := 0
+		for i, e := range c.entries {
+			if e.used < c.entries[lru].used {
+				lru = i
+			}
+		}
+		c.entries = append(c.entries[:lru], c.entries[lru+1:]...)
+		c.stats.Evictions++
+	}
+
+	c.tick++
+	e := &cacheEntry{start: start, succs: succs, used: c.tick, learned: now}
+	i := sort.Search(len(c.entries), func(i int) bool {
+		return bytes.Compare(c.entries[i].succs[0].Id, owner.Id) >= 0
+	})
+	c.entries = append(c.entries, nil)
+	copy(c.entries[i+1:], c.entries[i:])
+	c.entries[i] = e
+}
+
+// Drops the entries the predicate matches
+func (c *locationCache) drop(match func(e *cacheEntry) bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	kept := c.entries[:0]
+	for _, e := range c.entries {
+		if match(e) {
+			c.stats.Invalidations++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	c.entries = kept
+}
+
+// Drops all entries, without counting them as invalidated
+func (c *locationCache) clear() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// Drops the entries that use a vnode that failed or left
+func (c *locationCache) evict(vn *Vnode) {
+	if vn == nil {
+		return
+	}
+	c.drop(func(e *cacheEntry) bool {
+		for _, s := range e.succs {
+			if s != nil && bytes.Equal(s.Id, vn.Id) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Drops the entries whose range a newly learned vnode falls inside
+func (c *locationCache) joined(vn *Vnode) {
+	if vn == nil {
+		return
+	}
+	c.drop(func(e *cacheEntry) bool {
+		return global.Between(e.start, e.succs[0].Id, vn.Id)
+	})
+}
+
+// Drops the entry holding a key
+func (c *locationCache) invalidate(key []byte) {
+	c.drop(func(e *cacheEntry) bool {
+		return global.BetweenRightIncl(e.start, e.succs[0].Id, key)
+	})
+}
+
+// Returns a copy of the counters
+func (c *locationCache) snapshot() LocationCacheStats {
+	if c == nil {
+		return LocationCacheStats{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.stats
+	s.Size = len(c.entries)
+	return s
+}
+
+// Returns the counters accumulated since an earlier snapshot
+func (s LocationCacheStats) since(prev LocationCacheStats) LocationCacheStats {
+	return LocationCacheStats{
+		Size:          s.Size,
+		Hits:          s.Hits - prev.Hits,
+		Misses:        s.Misses - prev.Misses,
+		Evictions:     s.Evictions - prev.Evictions,
+		Invalidations: s.Invalidations - prev.Invalidations,
+		Expirations:   s.Expirations - prev.Expirations,
+	}
+}
+
+// Returns the ID preceding an ID on a ring of the given bit size
+func previousId(id []byte, bits int) []byte {
+	var ring, prev big.Int
+	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
+	prev.SetBytes(id)
+	prev.Sub(&prev, big.NewInt(1))
+	prev.Mod(&prev, &ring)
+	return prev.FillBytes(make([]byte, len(id)))
+}
+
+// Drops the cached owner of a key, for callers that found it no longer holds
+// the key
+func (r *Ring) InvalidateLookup(key []byte) {
+	r.cache.invalidate(r.hashKey(key))
+}
+
+// Returns the hit rate and eviction counters of the location cache
+func (r *Ring) LocationCacheStats() LocationCacheStats {
+	return r.cache.snapshot()
+}
@@ -0,0 +1,199 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ahrtr/logrus"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+type ChurnParams struct {
+	Version            string        // Version of chord used for joins, "old" or "new"
+	NumEvents          int           // Number of join/leave/fail events to fire
+	EventFireDelay     time.Duration // Time between the firing of successive events
+	QueryInterval      time.Duration // Length of each reporting interval
+	QueriesPerInterval int           // Number of queries issued in each interval
+}
+
+type ChurnPerformance struct {
+	/*
+		Lookup performance during a single interval of churn is stored in an object of this type
+		Interval (int): Index of the interval
+		Elapsed (time.Duration): Time since the start of the run at the end of the interval
+		NumNodes (int): Number of live vnodes at the end of the interval
+		Events (int): Number of events fired so far
+		NumberOfQueries (int): Number of queries issued in the interval
+		Successes (int): Number of queries that returned an owner
+		WrongOwners (int): Number of successful queries whose owner differs from the ground truth
+		Latencies ([]time.Duration): Time taken by each individual query of the interval
+	*/
+	Interval        int
+	Elapsed         time.Duration
+	NumNodes        int
+	Events          int
+	NumberOfQueries int
+	Successes       int
+	WrongOwners     int
+	Latencies       []time.Duration
+}
+
+var ChurnPerformanceMetrics []ChurnPerformance
+
+/*
+	This function measures lookups while the ring is churning. Random join, leave and
+	fail events are fired in the background using the same machinery as the correctness
+	testing, while a query workload runs from random live vnodes. Each result is checked
+	against the owner computed from the set of live vnodes, and the success rate,
+	wrong owner rate and latency are recorded for every interval until all the events
+	have been fired.
+*/
+func (r *Ring) TestChurn(params ChurnParams) {
+	if params.QueriesPerInterval < 1 {
+		params.QueriesPerInterval = 1
+	}
+	events := r.generateEvents(params.NumEvents)
+	fired := 0
+	done := make(chan bool)
+	go func() {
+		id := len(r.localVnodes())
+		for _, event := range events {
+			time.Sleep(params.EventFireDelay)
+			r.applyEvent(event, &id, params.Version)
+			r.lock.Lock()
+			fired++
+			r.lock.Unlock()
+			logrus.Infoln(r.PrintNodes())
+		}
+		done <- true
+	}()
+
+	start := time.Now()
+	queryDelay := params.QueryInterval / time.Duration(params.QueriesPerInterval)
+	finished := false
+	for interval := 0; !finished; interval++ {
+		metric := ChurnPerformance{Interval: interval}
+		for i := 0; i < params.QueriesPerInterval; i++ {
+			success, wrongOwner, elapsed := r.churnQuery(RandStringRunes(8))
+			metric.NumberOfQueries++
+			metric.Latencies = append(metric.Latencies, elapsed)
+			if success {
+				metric.Successes++
+			}
+			if wrongOwner {
+				metric.WrongOwners++
+			}
+			time.Sleep(queryDelay)
+		}
+
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		r.lock.RLock()
+		metric.Elapsed = time.Since(start)
+		metric.NumNodes = len(r.vnodes)
+		metric.Events = fired
+		r.lock.RUnlock()
+		ChurnPerformanceMetrics = append(ChurnPerformanceMetrics, metric)
+		logrus.Infof("Interval %d: %d/%d successful, %d wrong owners", interval,
+			metric.Successes, metric.NumberOfQueries, metric.WrongOwners)
+	}
+}
+
+/*
+	Looks up a single query from a random live vnode and compares the result with the
+	owner among the live vnodes. The owner is taken when the lookup is issued and again
+	when it returns, and the result only counts as wrong if it matches neither, so churn
+	during the lookup is not blamed on it.
+*/
+func (r *Ring) churnQuery(query string) (success bool, wrongOwner bool, elapsed time.Duration) {
+	key := r.hashKey([]byte(query))
+	r.lock.RLock()
+	origin := r.vnodes[rand.Intn(len(r.vnodes))]
+	before := r.liveOwner(key)
+	r.lock.RUnlock()
+
+	start := time.Now()
+	successors, _, _, err := origin.FindSuccessors(1, key)
+	elapsed = time.Since(start)
+	if err != nil || len(successors) == 0 || successors[0] == nil {
+		return false, false, elapsed
+	}
+
+	r.lock.RLock()
+	after := r.liveOwner(key)
+	r.lock.RUnlock()
+	if !bytes.Equal(successors[0].Id, before.Id) && !bytes.Equal(successors[0].Id, after.Id) {
+		logrus.Infof("Wrong owner for key %s: got %d, expected %d", query, successors[0].Num, after.Num)
+		return true, true, elapsed
+	}
+	return true, false, elapsed
+}
+
+// Returns the live local vnode that owns the key. The ring lock must be held.
+func (r *Ring) liveOwner(key []byte) *Vnode {
+	for _, vn := range r.vnodes {
+		if bytes.Compare(vn.Id, key) >= 0 {
+			return &vn.Vnode
+		}
+	}
+	return &r.vnodes[0].Vnode
+}
+
+/*
+	This function is used to generate logs regarding lookup performance under churn.
+	Results are saved in churnPerformance.csv
+*/
+func LogChurn() {
+	var churnHeader []string
+	churnHeader = append(churnHeader, "Interval")
+	churnHeader = append(churnHeader, "Elapsed Time")
+	churnHeader = append(churnHeader, "Number of Nodes")
+	churnHeader = append(churnHeader, "Events Fired")
+	churnHeader = append(churnHeader, "Number of Queries")
+	churnHeader = append(churnHeader, "Lookup Success Rate")
+	churnHeader = append(churnHeader, "Wrong Owner Rate")
+	churnHeader = append(churnHeader, "Average Lookup Latency (per query)")
+	churnHeader = append(churnHeader, "p50 Lookup Latency (per query)")
+	churnHeader = append(churnHeader, "p99 Lookup Latency (per query)")
+	churnHeader = append(churnHeader, "Max Lookup Latency (per query)")
+
+	var churnData [][]string
+	for _, churnPerformance := range ChurnPerformanceMetrics {
+		total := time.Duration(0)
+		for _, latency := range churnPerformance.Latencies {
+			total += latency
+		}
+		latency := computePercentiles(durationSamples(churnPerformance.Latencies))
+
+		var data []string
+		data = append(data, strconv.Itoa(churnPerformance.Interval))
+		data = append(data, strconv.Itoa(int(churnPerformance.Elapsed)))
+		data = append(data, strconv.Itoa(churnPerformance.NumNodes))
+		data = append(data, strconv.Itoa(churnPerformance.Events))
+		data = append(data, strconv.Itoa(churnPerformance.NumberOfQueries))
+		data = append(data, fmt.Sprintf("%f", rate(churnPerformance.Successes, churnPerformance.NumberOfQueries)))
+		data = append(data, fmt.Sprintf("%f", rate(churnPerformance.WrongOwners, churnPerformance.Successes)))
+		data = append(data, strconv.Itoa(safeDivide(int(total), churnPerformance.NumberOfQueries)))
+		data = append(data, strconv.Itoa(int(latency.P50)))
+		data = append(data, strconv.Itoa(int(latency.P99)))
+		data = append(data, strconv.Itoa(int(latency.Max)))
+		churnData = append(churnData, data)
+	}
+
+	if err := writeCSV("churnPerformance.csv", churnHeader, churnData); err != nil {
+		logrus.Errorln("Unable to write churn performance:", err.Error())
+	}
+}
+
+// Returns a / b as a fraction, 0 when b is 0
+func rate(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
@@ -0,0 +1,198 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ahrtr/logrus"
+	"hash"
+	"sort"
+	"strconv"
+)
+
+type DistributionParams struct {
+	NumHosts      int       // Number of hosts in the ring
+	NumVnodes     int       // Initial number of vnodes per host of weight 1
+	NumKeys       int       // Number of keys in the workload
+	KeyPattern    string    // "random" for random keys, "sequential" for key-0, key-1, ...
+	VnodeSteps    int       // Increase in the number of vnodes per host for the next step
+	NumVnodeSteps int       // Number of steps of the sweep
+	Weights       []float64 // Capacity weight of each host, repeated over the hosts, nil for equal weights
+}
+
+type LoadDistribution struct {
+	/*
+		Load balance of a ring with a given number of vnodes per host is stored in an object of this type
+		NumHosts (int): Number of hosts in the ring
+		VnodesPerHost (int): Number of vnodes on each host of weight 1
+		NumKeys (int): Number of keys in the workload
+		VnodeShares ([]float64): Fraction of the keys owned by each vnode
+		HostShares (map[string]float64): Fraction of the keys owned by each host
+		HostWeights (map[string]float64): Capacity weight of each host
+		HostVnodes (map[string]int): Number of vnodes on each host
+	*/
+	NumHosts      int
+	VnodesPerHost int
+	NumKeys       int
+	VnodeShares   []float64
+	HostShares    map[string]float64
+	HostWeights   map[string]float64
+	HostVnodes    map[string]int
+}
+
+var LoadDistributionResults []LoadDistribution
+
+/*
+	This function analyses how evenly keys spread across vnodes and hosts. For every step
+	of the sweep, the vnode IDs of all the hosts are generated the same way the ring does,
+	the key workload is hashed onto the ring and the ownership share of every vnode and
+	host is recorded. Hosts with a capacity weight get as many vnodes as the ring would
+	give them. No ring is started, so large rings can be analysed quickly.
+*/
+func TestDistribution(params DistributionParams, hashFunc func() hash.Hash) {
+	keys := generateKeys(params.NumKeys, params.KeyPattern, hashFunc)
+	vnodesPerHost := params.NumVnodes
+	for i := 0; i < params.NumVnodeSteps; i++ {
+		hostWeights := make(map[string]float64)
+		hostVnodes := make(map[string]int)
+		for h := 0; h < params.NumHosts; h++ {
+			host := "host-" + strconv.Itoa(h)
+			hostWeights[host] = 1
+			if len(params.Weights) > 0 && params.Weights[h%len(params.Weights)] > 0 {
+				hostWeights[host] = params.Weights[h%len(params.Weights)]
+			}
+			hostVnodes[host] = weightedVnodes(vnodesPerHost, hostWeights[host])
+		}
+		vnodes := genHostVnodes(hostVnodes, hashFunc)
+		vnodeShares, hostShares := keyShares(vnodes, keys)
+		LoadDistributionResults = append(LoadDistributionResults, LoadDistribution{
+			NumHosts:      params.NumHosts,
+			VnodesPerHost: vnodesPerHost,
+			NumKeys:       len(keys),
+			VnodeShares:   vnodeShares,
+			HostShares:    hostShares,
+			HostWeights:   hostWeights,
+			HostVnodes:    hostVnodes,
+		})
+		vnodesPerHost += params.VnodeSteps
+	}
+}
+
+// Generates the hashed keys of the workload
+func generateKeys(num int, pattern string, hashFunc func() hash.Hash) [][]byte {
+	keys := make([][]byte, num)
+	for i := range keys {
+		key := RandStringRunes(8)
+		if pattern == "sequential" {
+			key = fmt.Sprintf("key-%d", i)
+		}
+		h := hashFunc()
+		h.Write([]byte(key))
+		keys[i] = h.Sum(nil)
+	}
+	return keys
+}
+
+// Generates the given number of vnodes of each host, sorted by ID
+func genHostVnodes(hostVnodes map[string]int, hashFunc func() hash.Hash) []*Vnode {
+	var vnodes []*Vnode
+	for host, num := range hostVnodes {
+		for i := 0; i < num; i++ {
+			vnodes = append(vnodes, &Vnode{Num: i, Id: genVnodeId(hashFunc, host, uint16(i)), Host: host})
+		}
+	}
+	sort.Slice(vnodes, func(i, j int) bool {
+		return bytes.Compare(vnodes[i].Id, vnodes[j].Id) == -1
+	})
+	return vnodes
+}
+
+/*
+	Assigns each key to its successor among the sorted vnodes and returns the fraction
+	of the keys owned by each vnode and by each host.
+*/
+func keyShares(vnodes []*Vnode, keys [][]byte) ([]float64, map[string]float64) {
+	counts := make([]int, len(vnodes))
+	for _, key := range keys {
+		idx := sort.Search(len(vnodes), func(i int) bool {
+			return bytes.Compare(vnodes[i].Id, key) >= 0
+		})
+		counts[idx%len(vnodes)]++
+	}
+
+	vnodeShares := make([]float64, len(vnodes))
+	hostShares := make(map[string]float64)
+	for i, vn := range vnodes {
+		vnodeShares[i] = rate(counts[i], len(keys))
+		hostShares[vn.Host] += vnodeShares[i]
+	}
+	return vnodeShares, hostShares
+}
+
+/*
+	This function is used to generate logs regarding the load distribution analysis.
+	The summary of each step of the sweep is saved in loadDistribution.csv and the
+	ownership share of every host against its weight in hostLoad.csv. The host Gini
+	coefficient and max/mean ratio are computed over the ownership share of each host
+	divided by its share of the total weight, so a host owning exactly its share of the
+	keyspace scores 1.
+*/
+func LogDistribution() {
+	var distributionHeader []string
+	distributionHeader = append(distributionHeader, "Number of Hosts")
+	distributionHeader = append(distributionHeader, "Vnodes per Host")
+	distributionHeader = append(distributionHeader, "Number of Keys")
+	distributionHeader = append(distributionHeader, "Vnode Gini Coefficient")
+	distributionHeader = append(distributionHeader, "Vnode Max/Mean Ratio")
+	distributionHeader = append(distributionHeader, "Host Gini Coefficient")
+	distributionHeader = append(distributionHeader, "Host Max/Mean Ratio")
+
+	var hostHeader []string
+	hostHeader = append(hostHeader, "Vnodes per Host")
+	hostHeader = append(hostHeader, "Host")
+	hostHeader = append(hostHeader, "Weight")
+	hostHeader = append(hostHeader, "Vnodes")
+	hostHeader = append(hostHeader, "Ownership Share")
+	hostHeader = append(hostHeader, "Weight Share")
+	hostHeader = append(hostHeader, "Ownership/Weight Ratio")
+
+	var distributionData [][]string
+	var hostData [][]string
+	for _, distribution := range LoadDistributionResults {
+		var hosts []string
+		for host := range distribution.HostShares {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		totalWeight := 0.0
+		for _, host := range hosts {
+			totalWeight += distribution.HostWeights[host]
+		}
+		hostLoads := make([]float64, len(hosts))
+		for i, host := range hosts {
+			share := distribution.HostShares[host]
+			weightShare := distribution.HostWeights[host] / totalWeight
+			hostLoads[i] = share / weightShare
+			hostData = append(hostData, []string{strconv.Itoa(distribution.VnodesPerHost), host,
+				fmt.Sprintf("%f", distribution.HostWeights[host]), strconv.Itoa(distribution.HostVnodes[host]),
+				fmt.Sprintf("%f", share), fmt.Sprintf("%f", weightShare), fmt.Sprintf("%f", hostLoads[i])})
+		}
+
+		var data []string
+		data = append(data, strconv.Itoa(distribution.NumHosts))
+		data = append(data, strconv.Itoa(distribution.VnodesPerHost))
+		data = append(data, strconv.Itoa(distribution.NumKeys))
+		data = append(data, fmt.Sprintf("%f", giniCoefficient(distribution.VnodeShares)))
+		data = append(data, fmt.Sprintf("%f", maxMeanRatio(distribution.VnodeShares)))
+		data = append(data, fmt.Sprintf("%f", giniCoefficient(hostLoads)))
+		data = append(data, fmt.Sprintf("%f", maxMeanRatio(hostLoads)))
+		distributionData = append(distributionData, data)
+	}
+
+	if err := writeCSV("loadDistribution.csv", distributionHeader, distributionData); err != nil {
+		logrus.Errorln("Unable to write load distribution:", err.Error())
+		return
+	}
+	if err := writeCSV("hostLoad.csv", hostHeader, hostData); err != nil {
+		logrus.Errorln("Unable to write host load:", err.Error())
+	}
+}
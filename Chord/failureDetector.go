@@ -0,0 +1,319 @@
+package chord
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+udpDetector is a lightweight failure detector that sends heartbeats over UDP,
+separate from the RPC transport. It listens on the UDP port of the same address
+as the TCP transport, so the host of a vnode is also its heartbeat address.
+
+Every interval a ping is sent to each watched vnode, and the host answers with
+an ack telling whether the vnode is registered there. Positive acks are the
+heartbeats of a phi accrual detector, a vnode is alive while its suspicion is
+below the threshold. A vnode that never acked is dead once the timeout passes.
+Vnodes stop being watched once nobody has asked about them for a while.
+
+	ping = uint8 type | uint32 sequence | bytes vnode ID
+	ack  = uint8 type | uint32 sequence | uint8 alive
+
+Sequences are random, and an ack only counts if it comes from the host that was
+pinged. With a ring identity the body after the sequence is sealed in the same
+envelope as TCP payloads, so hosts of other rings cannot forge acks.
+*/
+type udpDetector struct {
+	conn      *net.UDPConn
+	interval  time.Duration
+	timeout   time.Duration        // Time to wait for the first ack
+	threshold float64              // Phi above which a vnode is dead
+	expire    time.Duration        // Vnodes not asked about for this long are dropped
+	local     func(vn *Vnode) bool // Whether a vnode is registered on this host
+	ident     *ringIdentity        // Ring identity packets are sealed with, nil for none
+	lock      sync.Mutex
+	watched   map[string]*watchedVnode
+	pending   map[uint32]*udpPending
+	shutdown  int32
+}
+
+// Heartbeat state of a watched vnode
+type watchedVnode struct {
+	vn      *Vnode
+	since   time.Time   // When the vnode was first watched
+	history *phiAccrual // Arrivals of positive acks
+	gone    bool        // Set when the host acked that the vnode is not registered
+	asked   time.Time   // When the vnode was last asked about
+}
+
+// A ping waiting for its ack
+type udpPending struct {
+	key  string
+	host string // Host the ping was sent to
+	sent time.Time
+}
+
+// Heartbeat packet types
+const (
+	udpPing = iota + 1
+	udpAck
+)
+
+// Largest heartbeat packet that is read
+const udpMaxPacketSize = 1024
+
+// Sealed in place of the session nonce, so heartbeats and TCP frames never
+// share an HMAC
+var udpSealNonce = []byte("CHRD heartbeat")
+
+// Starts a failure detector listening on the UDP port of the given address
+func initUDPDetector(listen string, interval, timeout, expire time.Duration, threshold float64,
+	local func(vn *Vnode) bool, ident *ringIdentity) (*udpDetector, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &udpDetector{conn: conn,
+		interval:  interval,
+		timeout:   timeout,
+		threshold: threshold,
+		expire:    expire,
+		local:     local,
+		ident:     ident,
+		watched:   make(map[string]*watchedVnode),
+		pending:   make(map[uint32]*udpPending)}
+
+	// Answer pings and collect acks
+	go d.listen()
+
+	// Send heartbeats
+	go d.probe()
+	return d, nil
+}
+
+// Stops the failure detector
+func (d *udpDetector) stop() {
+	atomic.StoreInt32(&d.shutdown, 1)
+	d.conn.Close()
+}
+
+// Starts watching the given vnodes, or marks them as asked about
+func (d *udpDetector) watch(vns ...*Vnode) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	for _, vn := range vns {
+		if vn == nil {
+			continue
+		}
+		d.watchLocked(vn, now)
+	}
+}
+
+func (d *udpDetector) watchLocked(vn *Vnode, now time.Time) *watchedVnode {
+	key := vn.String()
+	w, ok := d.watched[key]
+	if !ok {
+		w = &watchedVnode{vn: vn, since: now, history: newPhiAccrual(d.interval)}
+		d.watched[key] = w
+	}
+	w.asked = now
+	return w
+}
+
+// Returns whether a vnode is alive. Known is false until the detector has
+// watched the vnode long enough to tell, the caller should fall back to
+// another check in that case. Starts watching the vnode if it is not yet.
+func (d *udpDetector) status(vn *Vnode) (alive bool, known bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	return d.statusLocked(d.watchLocked(vn, now), now)
+}
+
+// Returns whether a vnode is alive, like status, but only for vnodes that are
+// already watched. Never starts watching, so it is safe for vnodes that are
+// merely mentioned, such as cached owners.
+func (d *udpDetector) peek(vn *Vnode) (alive bool, known bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	w, ok := d.watched[vn.String()]
+	if !ok {
+		return false, false
+	}
+	return d.statusLocked(w, time.Now())
+}
+
+func (d *udpDetector) statusLocked(w *watchedVnode, now time.Time) (alive bool, known bool) {
+	switch {
+	case w.gone:
+		return false, true
+	case w.history.seen():
+		return w.history.phi(now) < d.threshold, true
+	case now.Sub(w.since) < d.timeout:
+		return false, false
+	}
+	return false, true
+}
+
+// Pings every watched vnode once per interval
+func (d *udpDetector) probe() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt32(&d.shutdown) == 1 {
+			return
+		}
+		d.probeOnce()
+	}
+}
+
+func (d *udpDetector) probeOnce() {
+	d.lock.Lock()
+	now := time.Now()
+
+	// Forget pings that will never be answered
+	for seq, p := range d.pending {
+		if now.Sub(p.sent) > d.timeout {
+			delete(d.pending, seq)
+		}
+	}
+
+	targets := make([]*Vnode, 0, len(d.watched))
+	seqs := make([]uint32, 0, len(d.watched))
+	for key, w := range d.watched {
+		// Stop watching vnodes nobody asks about
+		if now.Sub(w.asked) > d.expire {
+			delete(d.watched, key)
+			continue
+		}
+		seq := d.newSeqLocked()
+		d.pending[seq] = &udpPending{key: key, host: w.vn.Host, sent: now}
+		targets = append(targets, w.vn)
+		seqs = append(seqs, seq)
+	}
+	d.lock.Unlock()
+
+	for i, vn := range targets {
+		if err := d.send(vn.Host, udpPing, seqs[i], func(w *wireWriter) { w.putBytes(vn.Id) }); err != nil {
+			log.Printf("[ERR] Failed to send heartbeat to %s! Got %s", vn.Host, err)
+		}
+	}
+}
+
+// Returns a random sequence that no pending ping uses, so acks cannot be
+// guessed by hosts that did not see the ping
+func (d *udpDetector) newSeqLocked() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		seq := binary.BigEndian.Uint32(b[:])
+		if _, ok := d.pending[seq]; !ok {
+			return seq
+		}
+	}
+}
+
+// Sends a heartbeat packet
+func (d *udpDetector) send(host string, pktType uint8, seq uint32, body func(w *wireWriter)) error {
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return err
+	}
+	b := &wireWriter{}
+	body(b)
+	payload := b.buf.Bytes()
+	if d.ident != nil {
+		payload = d.ident.seal(udpSealNonce, pktType, uint64(seq), payload)
+	}
+	w := &wireWriter{}
+	w.putUint8(pktType)
+	w.putUint32(seq)
+	w.buf.Write(payload)
+	_, err = d.conn.WriteToUDP(w.buf.Bytes(), addr)
+	return err
+}
+
+// Returns whether a packet came from the given host
+func fromHost(host string, addr *net.UDPAddr) bool {
+	want, err := net.ResolveUDPAddr("udp", host)
+	return err == nil && want.IP.Equal(addr.IP) && want.Port == addr.Port
+}
+
+// Reads heartbeat packets, answering pings and recording acks
+func (d *udpDetector) listen() {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt32(&d.shutdown) == 1 {
+				return
+			}
+			log.Printf("[ERR] Failed to read heartbeat! Got %s", err)
+			continue
+		}
+		if err := d.handle(buf[:n], addr); err != nil {
+			log.Printf("[ERR] Invalid heartbeat from %s! Got %s", addr, err)
+		}
+	}
+}
+
+func (d *udpDetector) handle(packet []byte, addr *net.UDPAddr) error {
+	r := &wireReader{data: packet}
+	pktType := r.getUint8()
+	seq := r.getUint32()
+	if r.err != nil {
+		return r.err
+	}
+	if d.ident != nil {
+		body, _, err := d.ident.open(udpSealNonce, pktType, uint64(seq), r.data)
+		if err != nil {
+			return err
+		}
+		r = &wireReader{data: body}
+	}
+	switch pktType {
+	case udpPing:
+		id := r.getBytes()
+		if r.err != nil {
+			return r.err
+		}
+		alive := d.local(&Vnode{Id: id})
+		return d.send(addr.String(), udpAck, seq, func(w *wireWriter) { w.putBool(alive) })
+
+	case udpAck:
+		alive := r.getBool()
+		if r.err != nil {
+			return r.err
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		p, ok := d.pending[seq]
+		if !ok {
+			return nil
+		}
+		if !fromHost(p.host, addr) {
+			return fmt.Errorf("Ack for a ping to %s", p.host)
+		}
+		delete(d.pending, seq)
+		if w, ok := d.watched[p.key]; ok {
+			w.gone = !alive
+			if alive {
+				w.history.heartbeat(time.Now())
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown heartbeat type %d", pktType)
+}
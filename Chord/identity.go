@@ -0,0 +1,111 @@
+package chord
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Implemented by transports that can check the ring identity of remote messages
+type RingIdentityChecker interface {
+	// Sets the ring ID and shared secret that every message must carry. Messages
+	// from other rings are rejected and reported to the rejected callback with
+	// the address of the remote host and the ring ID it claimed.
+	SetRingIdentity(ringID string, secret []byte, rejected func(remote, ringID string))
+}
+
+// Implemented by delegates that want to know about rejected messages
+type ForeignRingDelegate interface {
+	// A message from another ring was rejected
+	ForeignRing(remote string, ringID string)
+}
+
+// The ring ID and shared secret messages are sealed with
+type ringIdentity struct {
+	id     string
+	secret []byte
+}
+
+// Bytes of the nonce each side of a connection contributes
+const sessionNonceSize = 16
+
+// Generates the random nonce this side of a connection contributes
+func newSessionNonce() ([]byte, error) {
+	nonce := make([]byte, sessionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Returns the oldest protocol version a peer must speak to be trusted. Request
+// IDs restart on every connection, so an HMAC that is not bound to the nonces
+// of the connection could be replayed on another one.
+func (ri *ringIdentity) minVersion() uint16 {
+	if ri.secret != nil {
+		return tcpNonceVersion
+	}
+	return tcpIdentityVersion
+}
+
+// Seals a message body into an envelope, from protocol version 3:
+//
+//	envelope = bytes ring ID | bytes body | bytes HMAC-SHA256
+//
+// The HMAC covers the session nonce, frame type, request ID, ring ID and body,
+// and is empty when no secret is configured. The nonce is nil before version 7.
+func (ri *ringIdentity) seal(nonce []byte, msgType uint8, reqID uint64, body []byte) []byte {
+	w := &wireWriter{}
+	w.putString(ri.ringID())
+	w.putBytes(body)
+	w.putBytes(ri.mac(nonce, msgType, reqID, ri.ringID(), body))
+	return w.buf.Bytes()
+}
+
+// Opens an envelope, verifying the ring ID and HMAC. Returns the body and the
+// ring ID it claimed, the error wraps ErrForeignRing if it fails verification.
+// Without an identity of our own every envelope is accepted.
+func (ri *ringIdentity) open(nonce []byte, msgType uint8, reqID uint64, envelope []byte) ([]byte, string, error) {
+	r := &wireReader{data: envelope}
+	ringID := r.getString()
+	body := r.getBytes()
+	mac := r.getBytes()
+	if r.err != nil {
+		return nil, "", r.err
+	}
+	if ri == nil {
+		return body, ringID, nil
+	}
+	if ringID != ri.id {
+		return nil, ringID, fmt.Errorf("%w Got ring %q, expected %q", ErrForeignRing, ringID, ri.id)
+	}
+	if ri.secret != nil && !hmac.Equal(mac, ri.mac(nonce, msgType, reqID, ringID, body)) {
+		return nil, ringID, fmt.Errorf("%w Invalid message authentication code", ErrForeignRing)
+	}
+	return body, ringID, nil
+}
+
+// Returns the ring ID, empty when no identity is configured
+func (ri *ringIdentity) ringID() string {
+	if ri == nil {
+		return ""
+	}
+	return ri.id
+}
+
+// Computes the HMAC of a message, nil when no secret is configured
+func (ri *ringIdentity) mac(nonce []byte, msgType uint8, reqID uint64, ringID string, body []byte) []byte {
+	if ri == nil || ri.secret == nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, ri.secret)
+	h.Write(nonce)
+	h.Write([]byte{msgType})
+	binary.Write(h, binary.BigEndian, reqID)
+	binary.Write(h, binary.BigEndian, uint32(len(ringID)))
+	h.Write([]byte(ringID))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -6,10 +6,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"log"
 	"time"
 	"github.com/ahrtr/logrus"
 	"math/rand"
+	"sync"
 )
 
 // Represents an Vnode, local or remote
@@ -29,8 +31,12 @@ type localVnode struct {
 	predecessor *Vnode
 	stabilized  time.Time
 	timer       *time.Timer
+	timerLock   sync.Mutex // Guards timer, set from the timer goroutine
 	DataStore   Storage
 	Shutdown    bool
+	stopped     int32              // Set once the vnode is removed, it no longer stabilizes
+	rebuild     chan fingerRebuild // Finger table rebuild run by the next stabilize
+	candidates  int                // Finger candidates in place of ProximityCandidates, 0 for none
 }
 
 // Converts the ID to string
@@ -50,6 +56,7 @@ func (vn *localVnode) init(idx int) {
 	// Initialize all state
 	vn.successors = make([]*Vnode, vn.ring.config.NumSuccessors)
 	vn.finger = make([]*Vnode, vn.ring.config.hashBits)
+	vn.rebuild = make(chan fingerRebuild, 1)
 
 	// Register with the RPC mechanism
 	vn.ring.transport.Register(&vn.Vnode, vn)
@@ -63,34 +70,59 @@ func (vn *localVnode) schedule(fail chan bool) {
 	f := func() {
 		vn.stabilize(fail)
 	}
+	vn.timerLock.Lock()
+	defer vn.timerLock.Unlock()
+	if vn.isStopped() {
+		return
+	}
 	vn.timer = time.AfterFunc(RandStabilize(vn.ring.config), f)
 }
 
 func (vn *localVnode) sendTimeToPerformanceMonitor(start time.Time, key string) {
-	MetricsHandler(vn.Num, time.Since(start), key, *vn.ring.config)
+	elapsed := time.Since(start)
+	// The weight changes at runtime
+	vn.ring.lock.RLock()
+	config := *vn.ring.config
+	vn.ring.lock.RUnlock()
+	MetricsHandler(vn.Num, elapsed, key, config)
 }
 
 // Generates an ID for the chord
 func (vn *localVnode) genId(idx uint16) {
-	// Use the hash funciton
 	conf := vn.ring.config
-	hash := conf.HashFunc()
-	hash.Write([]byte(conf.Hostname))
+	vn.Id = genVnodeId(conf.HashFunc, conf.Hostname, idx)
+}
+
+// Generates the ID of the vnode with the given index on a host
+func genVnodeId(hashFunc func() hash.Hash, hostname string, idx uint16) []byte {
+	// Use the hash funciton
+	hash := hashFunc()
+	hash.Write([]byte(hostname))
 	binary.Write(hash, binary.BigEndian, idx)
 
 	// Use the hash as the ID
-	vn.Id = hash.Sum(nil)
+	return hash.Sum(nil)
 }
 
 // Called to periodically stabilize the vnode
 func (vn *localVnode) stabilize(fail chan bool) {
 	start := time.Now()
 	// Clear the timer
+	vn.timerLock.Lock()
 	vn.timer = nil
+	vn.timerLock.Unlock()
+
+	// A removed vnode is not waited for on shutdown
+	if vn.isStopped() {
+		return
+	}
 
 	// Check for shutdown
-	if vn.ring.shutdown != nil {
-		vn.ring.shutdown <- true
+	vn.ring.lock.RLock()
+	shutdown := vn.ring.shutdown
+	vn.ring.lock.RUnlock()
+	if shutdown != nil {
+		shutdown <- true
 		return
 	}
 
@@ -102,6 +134,11 @@ func (vn *localVnode) stabilize(fail chan bool) {
 	// Setup the next stabilize timer
 	defer vn.schedule(fail)
 
+	// Keep heartbeats flowing to our neighbours
+	if vn.ring.detector != nil {
+		vn.ring.detector.watch(append([]*Vnode{vn.predecessor}, vn.successors...)...)
+	}
+
 	// Check for new successor
 	if err := vn.checkNewSuccessor(fail); err != nil {
 		log.Printf("[ERR] Error checking for new successor: %s", err)
@@ -112,6 +149,14 @@ func (vn *localVnode) stabilize(fail chan bool) {
 		log.Printf("[ERR] Error notifying successor: %s", err)
 	}
 
+	// Rebuild the finger table if asked to
+	select {
+	case req := <-vn.rebuild:
+		vn.rebuildFingers(req.candidates)
+		close(req.done)
+	default:
+	}
+
 	// Finger table fix up
 	if err := vn.fixFingerTable(); err != nil {
 		log.Printf("[ERR] Error fixing finger table: %s", err)
@@ -131,6 +176,9 @@ func (vn *localVnode) checkNewSuccessor(fail chan bool) error {
 	// Ask our successor for it's predecessor
 	trans := vn.ring.transport
 
+	// A successor an indirect probe reports alive may still be unreachable
+	// from here, so the check is restarted at most once per successor
+	restarts := 0
 CHECK_NEW_SUC:
 	succ := vn.successors[0]
 	if succ == nil {
@@ -147,7 +195,7 @@ CHECK_NEW_SUC:
 		known := vn.knownSuccessors()
 		if known > 1 {
 			for i := 0; i < known; i++ {
-				if alive, _ := trans.Ping(vn.successors[0]); !alive {
+				if alive, _ := vn.probe(vn.successors[0]); !alive {
 					// Don't eliminate the last successor we know of
 					if i+1 == known {
 						return fmt.Errorf("All known successors dead!")
@@ -156,8 +204,14 @@ CHECK_NEW_SUC:
 					// Advance the successors list past the dead one
 					copy(vn.successors[0:], vn.successors[1:])
 					vn.successors[known-1-i] = nil
+				} else if vn.successors[0] == succ || restarts >= len(vn.successors) {
+					// The successor is only suspected, or reported alive
+					// without answering us, keep it and try again in the
+					// next stabilize
+					return err
 				} else {
 					// Found live successor, check for new one
+					restarts++
 					goto CHECK_NEW_SUC
 				}
 			}
@@ -165,17 +219,27 @@ CHECK_NEW_SUC:
 		return err
 	}
 
+	// Never switch to a successor that fails verification
+	if err := vn.ring.verifyVnode(maybe_suc); err != nil {
+		return err
+	}
+
 	// Check if we should replace our successor
 	if maybe_suc != nil && global.Between(vn.Id, succ.Id, maybe_suc.Id) {
 		// Check if new successor is alive before switching
 		//alive, err := trans.Ping(maybe_suc)
 		if err == nil {
+			vn.ring.cache.joined(maybe_suc)
 			vn.successors[0] = maybe_suc
 			successors, _, _, err := trans.FindSuccessors(maybe_suc, vn.ring.config.NumSuccessors-1, maybe_suc.Id)
 			if err != nil {
 				return err
 			}
-			copy(vn.successors[1:], successors[:vn.ring.config.NumSuccessors-1])
+			successors = vn.ring.filterVnodes(successors)
+			if len(successors) > vn.ring.config.NumSuccessors-1 {
+				successors = successors[:vn.ring.config.NumSuccessors-1]
+			}
+			copy(vn.successors[1:], successors)
 		} else {
 			return err
 		}
@@ -199,6 +263,7 @@ func (vn *localVnode) notifySuccessor() error {
 	if err != nil {
 		return err
 	}
+	succ_list = vn.ring.filterVnodes(succ_list)
 
 	// Trim the successors list if too long
 	max_succ := vn.ring.config.NumSuccessors
@@ -222,6 +287,11 @@ func (vn *localVnode) notifySuccessor() error {
 
 // RPC: Notify is invoked when a Vnode gets notified
 func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
+	// Never accept a predecessor that fails verification
+	if err := vn.ring.verifyVnode(maybe_pred); err != nil {
+		return nil, err
+	}
+
 	// Check if we should update our predecessor
 	if vn.predecessor == nil || global.Between(vn.predecessor.Id, vn.Id, maybe_pred.Id) {
 		// Inform the delegate
@@ -231,6 +301,7 @@ func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 			conf.Delegate.NewPredecessor(&vn.Vnode, maybe_pred, old)
 		})
 
+		vn.ring.cache.joined(maybe_pred)
 		vn.predecessor = maybe_pred
 	}
 
@@ -244,15 +315,28 @@ func (vn *localVnode) fixFingerTable() error {
 	hb := vn.ring.config.hashBits
 	offset := global.PowerOffset(vn.Id, vn.last_finger, hb)
 
-	// Find the successor
-	nodes, _, _, err := vn.FindSuccessors(1, offset)
+	// Find the successor, and the candidates following it
+	nodes, _, _, err := vn.FindSuccessors(vn.fingerCandidates(), offset)
 	if nodes == nil || len(nodes) == 0 || err != nil {
 		return err
 	}
-	node := nodes[0]
-	if node == nil {
+	if nodes[0] == nil {
 		return errors.New("no known successors")
 	}
+	if err := vn.ring.verifyVnode(nodes[0]); err != nil {
+		// Drop the finger and go on with the next one, so a vnode failing
+		// verification does not hold up the rest of the table
+		vn.finger[vn.last_finger] = nil
+		vn.nextFinger()
+		return err
+	}
+
+	// Pick the nearest candidate within the finger interval
+	var end []byte
+	if vn.last_finger+1 < hb {
+		end = global.PowerOffset(vn.Id, vn.last_finger+1, hb)
+	}
+	node := vn.nearestCandidate(vn.ring.filterVnodes(nodes), end)
 
 	// Update the finger table
 	vn.finger[vn.last_finger] = node
@@ -275,20 +359,24 @@ func (vn *localVnode) fixFingerTable() error {
 	}
 
 	// Increment to the index to repair
-	if vn.last_finger+1 == hb {
+	vn.nextFinger()
+	return nil
+}
+
+// Moves on to the next finger to repair, wrapping around after the last one
+func (vn *localVnode) nextFinger() {
+	if vn.last_finger+1 == vn.ring.config.hashBits {
 		vn.last_finger = 0
 	} else {
 		vn.last_finger++
 	}
-
-	return nil
 }
 
 // Checks the health of our predecessor
 func (vn *localVnode) checkPredecessor() error {
 	// Check predecessor
 	if vn.predecessor != nil {
-		res, err := vn.ring.transport.Ping(vn.predecessor)
+		res, err := vn.probe(vn.predecessor)
 		if err != nil {
 			return err
 		}
@@ -301,8 +389,21 @@ func (vn *localVnode) checkPredecessor() error {
 	return nil
 }
 
-// Finds next N successors. N must be <= NumSuccessors
+// Limits a number of successors asked for, possibly by a remote vnode, to the
+// length of the successor list
+func (vn *localVnode) clampSuccessors(n int) int {
+	if n > len(vn.successors) {
+		return len(vn.successors)
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Finds next N successors. N is limited to NumSuccessors
 func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, int, int, error) {
+	n = vn.clampSuccessors(n)
 	// Check if we are the immediate predecessor
 	if bytes.Compare(key, vn.Id) == 0 || vn.successors[0] == nil {
 		return vn.successors[:n], 1, rand.Intn(3) + vn.ring.config.NumSuccessors - 3, nil
@@ -332,6 +433,8 @@ func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, int, int, err
 		// Try that chord, break on success
 		res, val, _, err := vn.ring.transport.FindSuccessors(closest, n, key)
 		if err == nil {
+			// Every vnode on the path remembers the result
+			vn.ring.cache.learn(key, nil, res, vn.ring.config.hashBits)
 			return res, 1+val, (1+val)*(rand.Intn(3) + vn.ring.config.NumSuccessors - 3), nil
 		} else {
 			log.Printf("[ERR] Failed to contact %s. Got %s", closest.String(), err)
@@ -353,7 +456,7 @@ func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, int, int, err
 	}
 
 	// Checked all closer nodes and our successors!
-	return nil, 0, 0, fmt.Errorf(vn.Vnode.String() + ": Exhausted all preceeding nodes! and %d", successors)
+	return nil, 0, 0, fmt.Errorf("%s: %w and %d", vn.Vnode.String(), ErrLookupExhausted, successors)
 }
 
 // Instructs the vnode to leave
@@ -380,6 +483,7 @@ func (vn *localVnode) leave() error {
 	}
 	vn.Shutdown = true
 	vn.ring.transport.Deregister(&vn.Vnode)
+	vn.ring.cache.evict(&vn.Vnode)
 	return err
 }
 
@@ -393,6 +497,10 @@ func (vn *localVnode) join(node *localVnode) (*Vnode, error) {
 	if err != nil {
 		return nil, err
 	}
+	successors = vn.ring.filterVnodes(successors)
+	if len(successors) == 0 {
+		return nil, errors.New("no successors found")
+	}
 	(*vn).successors[0] = successors[0]
 	successor := -1
 	if successors[0] != nil {
@@ -409,6 +517,10 @@ func (vn *localVnode) joinNew(node *localVnode) (*Vnode, error) {
 	if err != nil {
 		return nil, err
 	}
+	successors = vn.ring.filterVnodes(successors)
+	if len(successors) == 0 {
+		return nil, errors.New("no successors found")
+	}
 	for i := range successors {
 		(*vn).successors[i] = successors[i]
 	}
@@ -419,6 +531,7 @@ func (vn *localVnode) joinNew(node *localVnode) (*Vnode, error) {
 func (vn *localVnode) fail() error {
 	vn.Shutdown = true
 	vn.ring.transport.Deregister(&vn.Vnode)
+	vn.ring.cache.evict(&vn.Vnode)
 	return nil
 }
 
@@ -431,6 +544,7 @@ func (vn *localVnode) ClearPredecessor(p *Vnode) error {
 		vn.ring.invokeDelegate(func() {
 			conf.Delegate.PredecessorLeaving(&vn.Vnode, old)
 		})
+		vn.ring.cache.evict(old)
 		vn.predecessor = nil
 	}
 	return nil
@@ -446,6 +560,7 @@ func (vn *localVnode) SkipSuccessor(s *Vnode) error {
 		vn.ring.invokeDelegate(func() {
 			conf.Delegate.SuccessorLeaving(&vn.Vnode, old)
 		})
+		vn.ring.cache.evict(old)
 
 		known := vn.knownSuccessors()
 		copy(vn.successors[0:], vn.successors[1:])
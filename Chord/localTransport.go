@@ -14,10 +14,12 @@ type localRPC struct {
 // locally using direct method calls. For any non-local vnodes, the
 // request is passed on to another transport.
 type LocalTransport struct {
-	host   string
-	remote Transport
-	lock   sync.RWMutex
-	local  map[string]*localRPC
+	host    string
+	remote  Transport
+	lock    sync.RWMutex
+	local   map[string]*localRPC
+	stats   rpcCounters
+	latency LatencyMatrix // Emulated network between the vnodes, nil for none
 }
 
 // Creates a local transport to wrap a remote transport
@@ -57,6 +59,7 @@ func (lt *LocalTransport) ListVnodes(host string) ([]*Vnode, error) {
 		}
 		lt.lock.RUnlock()
 
+		lt.stats.record(rpcListVnodes, len(host), vnodesSize(res))
 		return res, nil
 	}
 
@@ -70,6 +73,7 @@ func (lt *LocalTransport) Ping(vn *Vnode) (bool, error) {
 
 	// If it exists locally, handle it
 	if ok {
+		lt.stats.record(rpcPing, vnodeSize(vn), 1)
 		return true, nil
 	}
 
@@ -83,7 +87,9 @@ func (lt *LocalTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 
 	// If it exists locally, handle it
 	if ok {
-		return obj.GetPredecessor()
+		pred, err := obj.GetPredecessor()
+		lt.stats.record(rpcGetPredecessor, vnodeSize(vn), vnodeSize(pred))
+		return pred, err
 	}
 
 	// Pass onto remote
@@ -96,7 +102,9 @@ func (lt *LocalTransport) Notify(vn, self *Vnode) ([]*Vnode, error) {
 
 	// If it exists locally, handle it
 	if ok {
-		return obj.Notify(self)
+		succs, err := obj.Notify(self)
+		lt.stats.record(rpcNotify, vnodeSize(vn)+vnodeSize(self), vnodesSize(succs))
+		return succs, err
 	}
 
 	// Pass onto remote
@@ -109,7 +117,9 @@ func (lt *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode
 
 	// If it exists locally, handle it
 	if ok {
-		return obj.FindSuccessors(n, key)
+		succs, jumps, lookups, err := obj.FindSuccessors(n, key)
+		lt.stats.record(rpcFindSuccessors, vnodeSize(vn)+8+len(key), vnodesSize(succs))
+		return succs, jumps, lookups, err
 	}
 
 	// Pass onto remote
@@ -122,6 +132,7 @@ func (lt *LocalTransport) ClearPredecessor(target, self *Vnode) error {
 
 	// If it exists locally, handle it
 	if ok {
+		lt.stats.record(rpcClearPredecessor, vnodeSize(target)+vnodeSize(self), 0)
 		return obj.ClearPredecessor(self)
 	}
 
@@ -135,6 +146,7 @@ func (lt *LocalTransport) SkipSuccessor(target, self *Vnode) error {
 
 	// If it exists locally, handle it
 	if ok {
+		lt.stats.record(rpcSkipSuccessor, vnodeSize(target)+vnodeSize(self), 0)
 		return obj.SkipSuccessor(self)
 	}
 
@@ -160,3 +172,13 @@ func (lt *LocalTransport) Deregister(v *Vnode) {
 	delete(lt.local, key)
 	lt.lock.Unlock()
 }
+
+// Returns the counters of the RPCs handled locally, merged with
+// those of the remote transport if it keeps any
+func (lt *LocalTransport) RPCStats() map[string]RPCStats {
+	stats := lt.stats.snapshot()
+	if remote, ok := lt.remote.(RPCStatsProvider); ok {
+		stats = mergeRPCStats(stats, remote.RPCStats())
+	}
+	return stats
+}
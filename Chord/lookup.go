@@ -0,0 +1,203 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+// How a lookup is routed around the ring
+type LookupMode int
+
+const (
+	// Each hop forwards the query to its closest preceding node, the default
+	RecursiveLookup LookupMode = iota
+	// The originating vnode asks each hop for its closest preceding nodes and
+	// contacts the next hop itself
+	IterativeLookup
+)
+
+func (m LookupMode) String() string {
+	switch m {
+	case RecursiveLookup:
+		return "recursive"
+	case IterativeLookup:
+		return "iterative"
+	}
+	return fmt.Sprintf("LookupMode(%d)", int(m))
+}
+
+// Parses a lookup mode from its name
+func ParseLookupMode(s string) (LookupMode, error) {
+	switch s {
+	case "recursive":
+		return RecursiveLookup, nil
+	case "iterative":
+		return IterativeLookup, nil
+	}
+	return RecursiveLookup, fmt.Errorf("Unknown lookup mode %q", s)
+}
+
+// Implemented by transports that can serve the hops of an iterative lookup
+type ClosestPrecedingFinder interface {
+	// Asks a vnode for the next hop towards a key. If its successor owns the
+	// key, up to n successors are returned. Otherwise the nodes closest
+	// preceding the key it knows of are returned, closest first.
+	ClosestPreceding(vn *Vnode, n int, key []byte) ([]*Vnode, []*Vnode, error)
+}
+
+// Number of next hop candidates returned by each step of an iterative lookup
+const iterativeCandidates = 3
+
+// RPC: Returns up to n successors if our successor owns the key, or the
+// closest preceding nodes we know of otherwise
+func (vn *localVnode) ClosestPreceding(n int, key []byte) ([]*Vnode, []*Vnode, error) {
+	n = vn.clampSuccessors(n)
+	// Check if we are the immediate predecessor
+	if bytes.Compare(key, vn.Id) == 0 || vn.successors[0] == nil {
+		return vn.successors[:n], nil, nil
+	}
+	if global.BetweenRightIncl(vn.Id, vn.successors[0].Id, key) {
+		return vn.successors[:n], nil, nil
+	}
+
+	// Collect the closest preceeding nodes
+	next := make([]*Vnode, 0, iterativeCandidates)
+	cp := closestPreceedingVnodeIterator{}
+	cp.init(vn, key)
+	for len(next) < iterativeCandidates {
+		closest, _ := cp.Next()
+		if closest == nil {
+			break
+		}
+		next = append(next, closest)
+	}
+	if len(next) > 0 {
+		return nil, next, nil
+	}
+
+	// Check if the ID is between us and any non-immediate successors
+	successors := vn.knownSuccessors()
+	for i := 1; i <= successors-n; i++ {
+		if global.BetweenRightIncl(vn.Id, vn.successors[i].Id, key) {
+			remain := vn.successors[i:]
+			if len(remain) > n {
+				remain = remain[:n]
+			}
+			return remain, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s: %w and %d", vn.Vnode.String(), ErrLookupExhausted, successors)
+}
+
+/*
+	Finds the next N successors of a key iteratively. Each step asks a vnode
+	for its closest preceding nodes and the next step is sent to the first of
+	them that answers, so a slow or dead hop only costs its own timeout and the
+	origin sees every hop of the path. Returns the same jump and lookup counts
+	as the recursive FindSuccessors.
+*/
+func (vn *localVnode) iterativeFindSuccessors(n int, key []byte) ([]*Vnode, int, int, error) {
+	succs, next, err := vn.ClosestPreceding(n, key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	finder, ok := vn.ring.transport.(ClosestPrecedingFinder)
+	if !ok && !foundSuccessors(succs) {
+		return nil, 0, 0, fmt.Errorf("Transport does not support iterative lookups")
+	}
+
+	jumps := 1
+	pred := &vn.Vnode
+	visited := map[string]bool{vn.String(): true}
+	for !foundSuccessors(succs) {
+		// Guard against routing loops between inconsistent vnodes
+		if jumps > vn.ring.config.hashBits {
+			return nil, jumps, 0, fmt.Errorf("%s: %w after %d hops", vn.Vnode.String(), ErrLookupExhausted, jumps)
+		}
+
+		// Take the first candidate that answers
+		candidates := next
+		next = nil
+		for _, hop := range candidates {
+			if visited[hop.String()] {
+				continue
+			}
+			visited[hop.String()] = true
+			s, nx, err := finder.ClosestPreceding(hop, n, key)
+			if err != nil {
+				log.Printf("[ERR] Failed to contact %s. Got %s", hop.String(), err)
+				continue
+			}
+			succs, next, pred = s, nx, hop
+			jumps++
+
+			// The hop is live, ranges it falls inside are stale
+			vn.ring.cache.joined(hop)
+			break
+		}
+		if !foundSuccessors(succs) && len(next) == 0 {
+			return nil, jumps, 0, fmt.Errorf("%s: %w and no hop answered", vn.Vnode.String(), ErrLookupExhausted)
+		}
+	}
+
+	// The hop that answered precedes the first successor
+	vn.ring.cache.learn(key, pred, succs, vn.ring.config.hashBits)
+	return succs, jumps, jumps * (rand.Intn(3) + vn.ring.config.NumSuccessors - 3), nil
+}
+
+// Reports whether a hop answered with successors. Remote hops send an empty
+// list when they only know the next candidates, and a vnode that lost its
+// successors answers with nil entries.
+func foundSuccessors(succs []*Vnode) bool {
+	return len(succs) > 0 && succs[0] != nil
+}
+
+// Finds the next N successors of a key using the given lookup mode
+func (vn *localVnode) lookup(mode LookupMode, n int, key []byte) ([]*Vnode, int, int, error) {
+	if mode == IterativeLookup {
+		return vn.iterativeFindSuccessors(n, key)
+	}
+	return vn.FindSuccessors(n, key)
+}
+
+// Asks a local vnode for the next hop, or passes the request on
+func (lt *LocalTransport) ClosestPreceding(vn *Vnode, n int, key []byte) ([]*Vnode, []*Vnode, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		local, ok := obj.(*localVnode)
+		if !ok {
+			return nil, nil, fmt.Errorf("Vnode %s does not support iterative lookups", vn.String())
+		}
+		succs, next, err := local.ClosestPreceding(n, key)
+		lt.stats.record(rpcClosestPreceding, vnodeSize(vn)+8+len(key), vnodesSize(succs)+vnodesSize(next))
+		return succs, next, err
+	}
+
+	// Pass onto remote
+	if remote, ok := lt.remote.(ClosestPrecedingFinder); ok {
+		return remote.ClosestPreceding(vn, n, key)
+	}
+	return nil, nil, fmt.Errorf("Transport does not support iterative lookups")
+}
+
+// Asks a remote vnode for the next hop
+func (t *TCPTransport) ClosestPreceding(vn *Vnode, n int, key []byte) ([]*Vnode, []*Vnode, error) {
+	body, err := t.call(vn.Host, tcpClosestPrecReq, &tcpBodyFindSuc{Target: vn, Num: n, Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, ok := body.(*tcpBodyTwoVnodeListError)
+	if !ok {
+		return nil, nil, unexpectedResponse(tcpClosestPrecReq, body)
+	}
+	if resp.Err != nil {
+		return nil, nil, resp.Err
+	}
+	return resp.Vnodes, resp.Next, nil
+}
@@ -0,0 +1,106 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Starts a ring of the given number of hosts over TCP, each running the
+// given number of vnodes, and waits for it to stabilize
+func startTCPRing(t *testing.T, hosts, vnodes int, mode LookupMode) []*Ring {
+	var rings []*Ring
+	for i := 0; i < hosts; i++ {
+		trans, err := InitTCPTransport("127.0.0.1:0", time.Second)
+		if err != nil {
+			t.Fatalf("Failed to start TCP transport. Got %s", err)
+		}
+		conf := DefaultConfig(trans.sock.Addr().String())
+		conf.NumVnodes = vnodes
+		conf.StabilizeMin = 10 * time.Millisecond
+		conf.StabilizeMax = 30 * time.Millisecond
+		conf.LookupMode = mode
+
+		var r *Ring
+		if i == 0 {
+			r, err = Create(conf, trans)
+		} else {
+			r, err = Join(conf, trans, rings[0].config.Hostname)
+		}
+		if err != nil {
+			t.Fatalf("Failed to start host %d. Got %s", i, err)
+		}
+		rings = append(rings, r)
+		t.Cleanup(func() {
+			r.Shutdown()
+			trans.Shutdown()
+		})
+	}
+	time.Sleep(time.Second)
+	return rings
+}
+
+// Returns the vnodes of all the rings, sorted by ID
+func sortedVnodes(rings []*Ring) []*Vnode {
+	var vnodes []*Vnode
+	for _, r := range rings {
+		for _, vn := range r.localVnodes() {
+			vnodes = append(vnodes, &vn.Vnode)
+		}
+	}
+	sort.Slice(vnodes, func(i, j int) bool {
+		return bytes.Compare(vnodes[i].Id, vnodes[j].Id) == -1
+	})
+	return vnodes
+}
+
+// Returns the vnode owning a hashed key
+func ownerOf(vnodes []*Vnode, key []byte) *Vnode {
+	for _, vn := range vnodes {
+		if bytes.Compare(vn.Id, key) >= 0 {
+			return vn
+		}
+	}
+	return vnodes[0]
+}
+
+func TestTCPIterativeLookup(t *testing.T) {
+	rings := startTCPRing(t, 4, 8, IterativeLookup)
+	vnodes := sortedVnodes(rings)
+
+	maxJumps := 0
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		owner := ownerOf(vnodes, rings[0].hashKey(key))
+		for h, r := range rings {
+			succs, err := r.Lookup(1, key)
+			if err != nil {
+				t.Fatalf("Lookup of %s on host %d failed. Got %s", key, h, err)
+			}
+			if len(succs) == 0 || succs[0] == nil {
+				t.Fatalf("Lookup of %s on host %d returned no successors", key, h)
+			}
+			if !bytes.Equal(succs[0].Id, owner.Id) {
+				t.Fatalf("Lookup of %s on host %d returned %s, expected %s", key, h, succs[0], owner)
+			}
+		}
+
+		// Count the hops taken from every vnode of the first host
+		for _, vn := range rings[0].localVnodes() {
+			_, jumps, _, err := vn.iterativeFindSuccessors(1, rings[0].hashKey(key))
+			if err != nil {
+				t.Fatalf("Iterative lookup of %s from %s failed. Got %s", key, vn, err)
+			}
+			if jumps > maxJumps {
+				maxJumps = jumps
+			}
+		}
+	}
+
+	// Some lookups must pass a remote hop that only knew the next candidates
+	if maxJumps < 3 {
+		t.Fatalf("Expected lookups of more than one remote hop. Got at most %d jumps", maxJumps)
+	}
+}
@@ -0,0 +1,59 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"fmt"
+)
+
+// An interval of IDs on the ring, (Start, End]. It wraps around the end of
+// the ring when Start is not below End, and covers the whole ring when they
+// are equal.
+type IDRange struct {
+	Start []byte // Exclusive
+	End   []byte // Inclusive
+}
+
+// Reports whether an ID lies in the interval
+func (rg IDRange) Contains(id []byte) bool {
+	if bytes.Equal(rg.Start, rg.End) {
+		return true
+	}
+	return global.BetweenRightIncl(rg.Start, rg.End, id)
+}
+
+func (rg IDRange) String() string {
+	return fmt.Sprintf("(%x, %x]", rg.Start, rg.End)
+}
+
+// Does a lookup for up to N successors of a raw ID, such as one hashed
+// beforehand, routed with the configured lookup mode. The ID must be as long
+// as the output of the hash function.
+func (r *Ring) LookupID(n int, id []byte) ([]*Vnode, error) {
+	if len(id)*8 != r.config.hashBits {
+		return nil, fmt.Errorf("ID is %d bits long, the ring uses %d bits", len(id)*8, r.config.hashBits)
+	}
+	return r.lookupID(r.config.LookupMode, n, id)
+}
+
+// Returns the interval of IDs a vnode owns, (predecessor, self]. The vnode is
+// asked for its current predecessor, local or remote.
+func (r *Ring) OwnerRange(vn *Vnode) (IDRange, error) {
+	pred, err := r.transport.GetPredecessor(vn)
+	if err != nil {
+		return IDRange{}, err
+	}
+	if pred == nil {
+		return IDRange{}, fmt.Errorf("%w Vnode %s", ErrPredecessorUnknown, vn.String())
+	}
+	return IDRange{Start: pred.Id, End: vn.Id}, nil
+}
+
+// Reports whether a vnode currently owns an ID
+func (r *Ring) Owns(vn *Vnode, id []byte) (bool, error) {
+	rg, err := r.OwnerRange(vn)
+	if err != nil {
+		return false, err
+	}
+	return rg.Contains(id), nil
+}
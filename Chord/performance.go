@@ -3,10 +3,12 @@ package chord
 import (
 	"fmt"
 	"github.com/ahrtr/logrus"
+	"math"
 	"math/rand"
 	"time"
 	"os"
 	"encoding/csv"
+	"sort"
 	"strconv"
 )
 
@@ -15,6 +17,9 @@ type PerformanceParams struct {
 	NumQueries    int
 	QuerySteps    int
 	NumQuerySteps int
+	Origin        *int          // Number of the vnode queries are issued from, nil for a random vnode per query
+	Modes         []LookupMode  // Lookup modes to compare on the same queries, recursive if empty
+	MaxRTT        time.Duration // Largest emulated round trip time, 0 to skip the finger selection comparison
 }
 
 type CPUPerformance struct {
@@ -36,15 +41,62 @@ type QueryPerformance struct {
 		Performance metric of batch queries is stored in an object of this type
 		NumberOfQueries (int): The number of queries in the batch
 		TimeElapsed (time.Duration): Time elapsed in processing the batch
+		Latencies ([]time.Duration): Time taken by each successful query of the batch
+		Jumps ([]int): Jump number of each successful query of the batch
+		Failures (int): Number of queries that failed, left out of the averages and samples
+		Origins (map[int]*OriginPerformance): Breakdown of the batch by the vnode the queries originated from
+		Mode (LookupMode): How the queries of the batch were routed
+		Cache (LocationCacheStats): Location cache counters of the batch, all 0 with the cache disabled
+		Verification (LookupStats): Outcomes of verifying the owners of the batch, all 0 unless VerifyLookups is set
 	*/
 	NumberOfQueries int
 	TimeElapsed     time.Duration
 	NumJumps        float64
 	Lookups         float64
+	Latencies       []time.Duration
+	Jumps           []int
+	Failures        int
+	Origins         map[int]*OriginPerformance
+	Mode            LookupMode
+	Cache           LocationCacheStats
+	Verification    LookupStats
 }
 
+type OriginPerformance struct {
+	/*
+		Performance of the queries issued from a single vnode is stored in an object of this type
+		NumberOfQueries (int): The number of successful queries issued from the vnode
+		TimeElapsed (time.Duration): Total time taken by those queries
+		Jumps (int): Total jump number of those queries
+		Failures (int): The number of failed queries issued from the vnode
+	*/
+	NumberOfQueries int
+	TimeElapsed     time.Duration
+	Jumps           int
+	Failures        int
+}
+
+type ProximityPerformance struct {
+	/*
+		Emulated latency of a batch of queries routed over one kind of finger table is stored in an object of this type
+		NumberOfQueries (int): The number of queries in the batch
+		Candidates (int): Candidates considered for each finger, 1 for exact successor fingers
+		Latencies ([]time.Duration): Emulated latency of each individual query of the batch
+		Jumps ([]int): Jump number of each individual query of the batch
+	*/
+	NumberOfQueries int
+	Candidates      int
+	Latencies       []time.Duration
+	Jumps           []int
+}
+
+// Finger candidates compared with exact successor fingers when
+// ProximityCandidates does not ask for more than one
+const comparedProximityCandidates = 4
+
 var CPUPerformanceMetrics []CPUPerformance
 var QueryPerformanceMetrics []QueryPerformance
+var ProximityPerformanceMetrics []ProximityPerformance
 var CorrectnessResults []CorrectnessResult
 var Events []Event
 var States []State
@@ -92,37 +144,177 @@ func MetricsHandler(node int, timeElapsed time.Duration, operation string, confi
 	   "Chord: A scalable peer-to-peer lookup service for internet applications")
 	4. Average Stabilization Time
 )
+	Queries are hashed the same way Ring.Lookup hashes keys and are issued from the vnode
+	numbered params.Origin, or from a uniformly random vnode for each query if it is nil,
+	so that the mean path length can be compared with the ½·log N of the Chord paper.
+	An origin that is not a vnode of the ring is an error.
+	With params.MaxRTT set, the vnodes are placed on an emulated network and the
+	same queries are also routed over exact successor and proximity fingers.
 */
-func (r *Ring) TestPerformance(params PerformanceParams) {
+func (r *Ring) TestPerformance(params PerformanceParams) error {
+	var fixedOrigin *localVnode
+	if params.Origin != nil {
+		for _, vn := range r.vnodes {
+			if vn.Num == *params.Origin {
+				fixedOrigin = vn
+			}
+		}
+		if fixedOrigin == nil {
+			return fmt.Errorf("No vnode numbered %d to issue queries from", *params.Origin)
+		}
+	}
+	modes := params.Modes
+	if len(modes) == 0 {
+		modes = []LookupMode{RecursiveLookup}
+	}
+	var latency LatencyMatrix
+	if lt, ok := r.transport.(*LocalTransport); ok && params.MaxRTT > 0 {
+		latency = NewLatencyMatrix(len(r.vnodes), params.MaxRTT)
+		lt.setLatencyMatrix(latency)
+	}
 	for i := 0; i < params.NumQuerySteps; i++ {
-		start := time.Now()
-		jumps := 0
-		lookups := 0
+		// Every mode runs the same queries from the same origins
+		var queries [][]string
+		var queryOrigins [][]*localVnode
 		for j := 0; j < params.N; j++ {
-			queries := generateQueries(params.NumQueries)
-			for _, query := range queries {
-				successors, val, lookup, err := r.vnodes[0].FindSuccessors(1, []byte(query))
-				if err != nil {
-					logrus.Errorln("Cannot find successors:", err.Error())
-				} else {
-					logrus.Infof("Node %d found for key %s", successors[0].Num, query)
-				}
-				jumps += val
-				lookups += lookup
+			queries = append(queries, generateQueries(params.NumQueries))
+			var batchOrigins []*localVnode
+			for range queries[j] {
+				batchOrigins = append(batchOrigins, r.queryOrigin(fixedOrigin))
 			}
+			queryOrigins = append(queryOrigins, batchOrigins)
 		}
-		jumpsFloat := float64(jumps) / float64(params.NumQueries * params.N)
-		lookupsFloat := float64(lookups) / float64(params.NumQueries * params.N)
-		queryPerformanceMetric := QueryPerformance{
-			NumberOfQueries: params.NumQueries,
-			TimeElapsed:     time.Since(start),
-			NumJumps:        jumpsFloat,
-			Lookups:         lookupsFloat,
+		for _, mode := range modes {
+			r.testQueries(params, mode, queries, queryOrigins)
+		}
+		if latency != nil {
+			r.testProximity(params, latency, queries, queryOrigins)
 		}
-		QueryPerformanceMetrics = append(QueryPerformanceMetrics, queryPerformanceMetric)
 		params.NumQueries += params.QuerySteps
 	}
 	time.Sleep(20 * time.Second)
+	return nil
+}
+
+// Runs the batches of queries of a single step with the given lookup mode
+func (r *Ring) testQueries(params PerformanceParams, mode LookupMode, queries [][]string, queryOrigins [][]*localVnode) {
+	start := time.Now()
+	jumps := 0
+	lookups := 0
+	failures := 0
+	var latencies []time.Duration
+	var jumpSamples []int
+	origins := make(map[int]*OriginPerformance)
+	// Every mode starts with an empty location cache, so it does not profit
+	// from the owners the previous mode learned
+	r.cache.clear()
+	cacheBefore := r.cache.snapshot()
+	verifiedBefore := r.LookupStats()
+	for j := range queries {
+		for k, query := range queries[j] {
+			origin := queryOrigins[j][k]
+			queryStart := time.Now()
+			successors, val, lookup, err := r.queryFrom(origin, mode, r.hashKey([]byte(query)))
+			elapsed := time.Since(queryStart)
+			originPerformance, ok := origins[origin.Num]
+			if !ok {
+				originPerformance = &OriginPerformance{}
+				origins[origin.Num] = originPerformance
+			}
+
+			// Failed queries would skew the latency and jump samples
+			if err == nil && (len(successors) == 0 || successors[0] == nil) {
+				err = fmt.Errorf("Lookup returned no successors")
+			}
+			if err != nil {
+				logrus.Errorln("Cannot find successors:", err.Error())
+				originPerformance.Failures++
+				failures++
+				continue
+			}
+			logrus.Infof("Node %d found for key %s", successors[0].Num, query)
+			latencies = append(latencies, elapsed)
+			jumpSamples = append(jumpSamples, val)
+			originPerformance.NumberOfQueries++
+			originPerformance.TimeElapsed += elapsed
+			originPerformance.Jumps += val
+			jumps += val
+			lookups += lookup
+		}
+	}
+	succeeded := params.NumQueries*params.N - failures
+	jumpsFloat := 0.0
+	lookupsFloat := 0.0
+	if succeeded > 0 {
+		jumpsFloat = float64(jumps) / float64(succeeded)
+		lookupsFloat = float64(lookups) / float64(succeeded)
+	}
+	queryPerformanceMetric := QueryPerformance{
+		NumberOfQueries: params.NumQueries,
+		TimeElapsed:     time.Since(start),
+		NumJumps:        jumpsFloat,
+		Lookups:         lookupsFloat,
+		Latencies:       latencies,
+		Jumps:           jumpSamples,
+		Failures:        failures,
+		Origins:         origins,
+		Mode:            mode,
+		Cache:           r.cache.snapshot().since(cacheBefore),
+		Verification:    r.LookupStats().since(verifiedBefore),
+	}
+	QueryPerformanceMetrics = append(QueryPerformanceMetrics, queryPerformanceMetric)
+}
+
+// Looks up the owner of a key from the given vnode as Ring.Lookup does, so
+// hot keys are answered from the location cache, taking no jumps
+func (r *Ring) queryFrom(origin *localVnode, mode LookupMode, key []byte) ([]*Vnode, int, int, error) {
+	k := r.lookupSize(1)
+	if successors, ok := r.cache.get(1, key, r.knownDead); ok {
+		return r.finishLookup(1, k, key, successors, true), 0, 0, nil
+	}
+	successors, jumps, lookups, err := origin.lookup(mode, k, key)
+	if err != nil {
+		return nil, jumps, lookups, err
+	}
+	return r.finishLookup(1, k, key, successors, false), jumps, lookups, nil
+}
+
+// Routes the queries of a single step over exact successor fingers and then
+// over proximity fingers, measuring the emulated latency of each
+func (r *Ring) testProximity(params PerformanceParams, latency LatencyMatrix, queries [][]string, queryOrigins [][]*localVnode) {
+	candidates := r.config.ProximityCandidates
+	if candidates <= 1 {
+		candidates = comparedProximityCandidates
+	}
+	defer r.rebuildFingers(0)
+	for _, c := range []int{1, candidates} {
+		r.rebuildFingers(c)
+		var latencies []time.Duration
+		var jumpSamples []int
+		for j := range queries {
+			for k, query := range queries[j] {
+				elapsed, jumps := r.emulatedLookup(latency, queryOrigins[j][k], r.hashKey([]byte(query)))
+				latencies = append(latencies, elapsed)
+				jumpSamples = append(jumpSamples, jumps)
+			}
+		}
+		proximityPerformanceMetric := ProximityPerformance{
+			NumberOfQueries: params.NumQueries,
+			Candidates:      c,
+			Latencies:       latencies,
+			Jumps:           jumpSamples,
+		}
+		ProximityPerformanceMetrics = append(ProximityPerformanceMetrics, proximityPerformanceMetric)
+	}
+}
+
+// Returns the vnode a query should be issued from, a random one if no origin
+// is fixed
+func (r *Ring) queryOrigin(origin *localVnode) *localVnode {
+	if origin == nil {
+		return r.vnodes[rand.Intn(len(r.vnodes))]
+	}
+	return origin
 }
 
 /*
@@ -157,62 +349,133 @@ func RandStringRunes(n int) string {
 /*
 	This function is used to generate logs regarding query performance and CPU utilization
 	of the run.
-	Results are saved in queryPerformance.csv and cpuPerformance.csv
+	Results are saved in queryPerformance.csv and cpuPerformance.csv, along with the
+	latency and jump number distributions in queryHistogram.csv, the stabilization
+	time distribution in stabilizationHistogram.csv and the per origin breakdown of
+	the queries in originPerformance.csv
 */
 func LogStats(num int, numNodes int) {
-	queryFile, err := os.Create("queryPerformance.csv")
-	if err != nil {
-		logrus.Errorln("Cannot create file", err.Error())
-		return
-	}
-	defer queryFile.Close()
-
-	cpuFile, err := os.Create("cpuPerformance.csv")
-	if err != nil {
-		logrus.Errorln("Cannot create file", err.Error())
-		return
-	}
-	defer cpuFile.Close()
-
-	queryWriter := csv.NewWriter(queryFile)
-
 	var queryHeader []string
 	queryHeader = append(queryHeader, "Number of Nodes")
 	queryHeader = append(queryHeader, "Number of Queries (nQ)")
+	queryHeader = append(queryHeader, "Lookup Mode")
 	queryHeader = append(queryHeader, "Number of Runs (n)")
 	queryHeader = append(queryHeader, "Average Lookup Latency (for all queries)")
 	queryHeader = append(queryHeader, "Average Lookup Latency (per query)")
+	queryHeader = append(queryHeader, "p50 Lookup Latency (per query)")
+	queryHeader = append(queryHeader, "p90 Lookup Latency (per query)")
+	queryHeader = append(queryHeader, "p99 Lookup Latency (per query)")
+	queryHeader = append(queryHeader, "Max Lookup Latency (per query)")
 	queryHeader = append(queryHeader, "Average Jump Number")
+	queryHeader = append(queryHeader, "p50 Jump Number")
+	queryHeader = append(queryHeader, "p90 Jump Number")
+	queryHeader = append(queryHeader, "p99 Jump Number")
+	queryHeader = append(queryHeader, "Max Jump Number")
+	queryHeader = append(queryHeader, "Expected Jump Number (1/2 log N)")
 	queryHeader = append(queryHeader, "Average Lookup Finger Table Number")
-	err = queryWriter.Write(queryHeader)
-	if err != nil {
-		logrus.Errorln("Unable to write query header:", err.Error())
-		return
-	}
+	queryHeader = append(queryHeader, "Failed Queries")
+	queryHeader = append(queryHeader, "Cache Hits")
+	queryHeader = append(queryHeader, "Cache Misses")
+	queryHeader = append(queryHeader, "Cache Hit Rate")
+	queryHeader = append(queryHeader, "Cache Evictions")
+	queryHeader = append(queryHeader, "Verified Lookups")
+	queryHeader = append(queryHeader, "Corrected Lookups")
+	queryHeader = append(queryHeader, "Unverified Lookups")
+
+	var queryHistogramHeader []string
+	queryHistogramHeader = append(queryHistogramHeader, "Number of Queries (nQ)")
+	queryHistogramHeader = append(queryHistogramHeader, "Lookup Mode")
+	queryHistogramHeader = append(queryHistogramHeader, "Metric")
+	queryHistogramHeader = append(queryHistogramHeader, "Bucket Upper Bound")
+	queryHistogramHeader = append(queryHistogramHeader, "Count")
+
+	var originHeader []string
+	originHeader = append(originHeader, "Number of Queries (nQ)")
+	originHeader = append(originHeader, "Lookup Mode")
+	originHeader = append(originHeader, "Origin Node")
+	originHeader = append(originHeader, "Number of Queries (from origin)")
+	originHeader = append(originHeader, "Average Lookup Latency (per query)")
+	originHeader = append(originHeader, "Average Jump Number")
+	originHeader = append(originHeader, "Failed Queries (from origin)")
 
+	expectedJumps := 0.5 * math.Log2(float64(numNodes))
 	var queryData [][]string
+	var queryHistogramData [][]string
+	var originData [][]string
 	for _, queryPerformance := range QueryPerformanceMetrics {
+		latencies := durationSamples(queryPerformance.Latencies)
+		jumps := intSamples(queryPerformance.Jumps)
+		latency := computePercentiles(latencies)
+		jump := computePercentiles(jumps)
+
 		var data []string
 		data = append(data, strconv.Itoa(numNodes))
 		data = append(data, strconv.Itoa(queryPerformance.NumberOfQueries))
+		data = append(data, queryPerformance.Mode.String())
 		data = append(data, strconv.Itoa(num))
-		data = append(data, strconv.Itoa(int(queryPerformance.TimeElapsed) / num))
-		data = append(data, strconv.Itoa(int(queryPerformance.TimeElapsed)/(queryPerformance.NumberOfQueries * num)))
+		data = append(data, strconv.Itoa(safeDivide(int(queryPerformance.TimeElapsed), num)))
+		data = append(data, strconv.Itoa(safeDivide(int(sumDurations(queryPerformance.Latencies)), len(queryPerformance.Latencies))))
+		data = append(data, strconv.Itoa(int(latency.P50)))
+		data = append(data, strconv.Itoa(int(latency.P90)))
+		data = append(data, strconv.Itoa(int(latency.P99)))
+		data = append(data, strconv.Itoa(int(latency.Max)))
 		data = append(data, fmt.Sprintf("%f", queryPerformance.NumJumps))
+		data = append(data, strconv.Itoa(int(jump.P50)))
+		data = append(data, strconv.Itoa(int(jump.P90)))
+		data = append(data, strconv.Itoa(int(jump.P99)))
+		data = append(data, strconv.Itoa(int(jump.Max)))
+		data = append(data, fmt.Sprintf("%f", expectedJumps))
 		data = append(data, fmt.Sprintf("%f", queryPerformance.Lookups))
+		data = append(data, strconv.Itoa(queryPerformance.Failures))
+		data = append(data, strconv.FormatUint(queryPerformance.Cache.Hits, 10))
+		data = append(data, strconv.FormatUint(queryPerformance.Cache.Misses, 10))
+		data = append(data, fmt.Sprintf("%f", queryPerformance.Cache.HitRate()))
+		data = append(data, strconv.FormatUint(queryPerformance.Cache.Evictions, 10))
+		data = append(data, strconv.FormatUint(queryPerformance.Verification.Verified, 10))
+		data = append(data, strconv.FormatUint(queryPerformance.Verification.Corrected, 10))
+		data = append(data, strconv.FormatUint(queryPerformance.Verification.Unverified, 10))
 		queryData = append(queryData, data)
-	}
 
-	for _, data := range queryData {
-		err = queryWriter.Write(data)
-		if err != nil {
-			logrus.Errorln("Unable to write query record:", err.Error())
-			return
+		nQ := strconv.Itoa(queryPerformance.NumberOfQueries)
+		mode := queryPerformance.Mode.String()
+		for _, bucket := range computeHistogram(latencies, latencyBounds(latencies)) {
+			queryHistogramData = append(queryHistogramData, []string{nQ, mode, "latency", formatBound(bucket.UpperBound), strconv.Itoa(bucket.Count)})
+		}
+		for _, bucket := range computeHistogram(jumps, unitBounds(jumps)) {
+			queryHistogramData = append(queryHistogramData, []string{nQ, mode, "jumps", formatBound(bucket.UpperBound), strconv.Itoa(bucket.Count)})
+		}
+
+		var originNodes []int
+		for node := range queryPerformance.Origins {
+			originNodes = append(originNodes, node)
+		}
+		sort.Ints(originNodes)
+		for _, node := range originNodes {
+			origin := queryPerformance.Origins[node]
+			var data []string
+			data = append(data, nQ)
+			data = append(data, mode)
+			data = append(data, strconv.Itoa(node))
+			data = append(data, strconv.Itoa(origin.NumberOfQueries))
+			data = append(data, strconv.Itoa(safeDivide(int(origin.TimeElapsed), origin.NumberOfQueries)))
+			data = append(data, fmt.Sprintf("%f", rate(origin.Jumps, origin.NumberOfQueries)))
+			data = append(data, strconv.Itoa(origin.Failures))
+			originData = append(originData, data)
 		}
 	}
-	queryWriter.Flush()
 
-	cpuWriter := csv.NewWriter(cpuFile)
+	if err := writeCSV("queryPerformance.csv", queryHeader, queryData); err != nil {
+		logrus.Errorln("Unable to write query performance:", err.Error())
+		return
+	}
+	if err := writeCSV("queryHistogram.csv", queryHistogramHeader, queryHistogramData); err != nil {
+		logrus.Errorln("Unable to write query histogram:", err.Error())
+		return
+	}
+	if err := writeCSV("originPerformance.csv", originHeader, originData); err != nil {
+		logrus.Errorln("Unable to write origin performance:", err.Error())
+		return
+	}
 
 	var cpuHeader []string
 	cpuHeader = append(cpuHeader, "Node")
@@ -220,73 +483,227 @@ func LogStats(num int, numNodes int) {
 	cpuHeader = append(cpuHeader, "Average Schedule Time")
 	cpuHeader = append(cpuHeader, "Number of stabilizations")
 	cpuHeader = append(cpuHeader, "Average Stabilization Time")
-	err = cpuWriter.Write(cpuHeader)
-	if err != nil {
-		logrus.Errorln("Unable to write cpu header:", err.Error())
-		return
-	}
+	cpuHeader = append(cpuHeader, "p50 Stabilization Time")
+	cpuHeader = append(cpuHeader, "p90 Stabilization Time")
+	cpuHeader = append(cpuHeader, "p99 Stabilization Time")
+	cpuHeader = append(cpuHeader, "Max Stabilization Time")
 
 	var cpuData [][]string
 	nodeScheduleMap := make(map[int]time.Duration)
 	nodeScheduleNumberMap := make(map[int]int)
 	totalScheduleTime := time.Duration(0)
 	schedule := 0
-	nodeStabilizationMap := make(map[int]time.Duration)
-	nodeStabilizationNumberMap := make(map[int]int)
+	nodeStabilizationMap := make(map[int][]time.Duration)
 	totalStabilizationTime := time.Duration(0)
-	stabilization := 0
+	var stabilizations []time.Duration
 	for _, cpuPerformance := range CPUPerformanceMetrics {
 		if cpuPerformance.Operation == "schedule" {
-			if val, ok := nodeScheduleMap[cpuPerformance.Node]; ok {
-				val += cpuPerformance.TimeElapsed
-				nodeScheduleMap[cpuPerformance.Node] = val
-				nodeScheduleNumberMap[cpuPerformance.Node] = nodeScheduleNumberMap[cpuPerformance.Node] + 1
-			} else {
-				nodeScheduleMap[cpuPerformance.Node] = cpuPerformance.TimeElapsed
-				nodeScheduleNumberMap[cpuPerformance.Node] = 1
-			}
+			nodeScheduleMap[cpuPerformance.Node] += cpuPerformance.TimeElapsed
+			nodeScheduleNumberMap[cpuPerformance.Node]++
 			totalScheduleTime += cpuPerformance.TimeElapsed
 			schedule++
 		} else if cpuPerformance.Operation == "stabilization" {
-			if val, ok := nodeStabilizationMap[cpuPerformance.Node]; ok {
-				val += cpuPerformance.TimeElapsed
-				nodeStabilizationMap[cpuPerformance.Node] = val
-				nodeStabilizationNumberMap[cpuPerformance.Node] = nodeStabilizationNumberMap[cpuPerformance.Node] + 1
-			} else {
-				nodeStabilizationMap[cpuPerformance.Node] = cpuPerformance.TimeElapsed
-				nodeStabilizationNumberMap[cpuPerformance.Node] = 1
-			}
+			nodeStabilizationMap[cpuPerformance.Node] = append(nodeStabilizationMap[cpuPerformance.Node], cpuPerformance.TimeElapsed)
 			totalStabilizationTime += cpuPerformance.TimeElapsed
-			stabilization++
+			stabilizations = append(stabilizations, cpuPerformance.TimeElapsed)
 		}
 	}
 
 	for node, value := range nodeScheduleMap {
+		nodeStabilizations := nodeStabilizationMap[node]
+		nodeStabilizationTime := time.Duration(0)
+		for _, elapsed := range nodeStabilizations {
+			nodeStabilizationTime += elapsed
+		}
+		stabilization := computePercentiles(durationSamples(nodeStabilizations))
+
 		var data []string
 		data = append(data, strconv.Itoa(node))
 		data = append(data, strconv.Itoa(nodeScheduleNumberMap[node]))
-		data = append(data, strconv.Itoa(int(value)/nodeScheduleNumberMap[node]))
-		data = append(data, strconv.Itoa(nodeStabilizationNumberMap[node]))
-		data = append(data, strconv.Itoa(int(nodeStabilizationMap[node])/nodeStabilizationNumberMap[node]))
+		data = append(data, strconv.Itoa(safeDivide(int(value), nodeScheduleNumberMap[node])))
+		data = append(data, strconv.Itoa(len(nodeStabilizations)))
+		data = append(data, strconv.Itoa(safeDivide(int(nodeStabilizationTime), len(nodeStabilizations))))
+		data = append(data, strconv.Itoa(int(stabilization.P50)))
+		data = append(data, strconv.Itoa(int(stabilization.P90)))
+		data = append(data, strconv.Itoa(int(stabilization.P99)))
+		data = append(data, strconv.Itoa(int(stabilization.Max)))
 		cpuData = append(cpuData, data)
 	}
 
+	stabilizationSamples := durationSamples(stabilizations)
+	stabilization := computePercentiles(stabilizationSamples)
 	var data []string
 	data = append(data, "All")
 	data = append(data, strconv.Itoa(schedule))
-	data = append(data, strconv.Itoa(int(totalScheduleTime)/schedule))
-	data = append(data, strconv.Itoa(stabilization))
-	data = append(data, strconv.Itoa(int(totalStabilizationTime)/stabilization))
+	data = append(data, strconv.Itoa(safeDivide(int(totalScheduleTime), schedule)))
+	data = append(data, strconv.Itoa(len(stabilizations)))
+	data = append(data, strconv.Itoa(safeDivide(int(totalStabilizationTime), len(stabilizations))))
+	data = append(data, strconv.Itoa(int(stabilization.P50)))
+	data = append(data, strconv.Itoa(int(stabilization.P90)))
+	data = append(data, strconv.Itoa(int(stabilization.P99)))
+	data = append(data, strconv.Itoa(int(stabilization.Max)))
 	cpuData = append(cpuData, data)
 
-	for _, data := range cpuData {
-		err = cpuWriter.Write(data)
-		if err != nil {
-			logrus.Errorln("Unable to write cpu record:", err.Error())
-			return
-		}
+	if err := writeCSV("cpuPerformance.csv", cpuHeader, cpuData); err != nil {
+		logrus.Errorln("Unable to write cpu performance:", err.Error())
+		return
+	}
+
+	var stabilizationHistogramHeader []string
+	stabilizationHistogramHeader = append(stabilizationHistogramHeader, "Bucket Upper Bound")
+	stabilizationHistogramHeader = append(stabilizationHistogramHeader, "Count")
+
+	var stabilizationHistogramData [][]string
+	for _, bucket := range computeHistogram(stabilizationSamples, latencyBounds(stabilizationSamples)) {
+		stabilizationHistogramData = append(stabilizationHistogramData, []string{formatBound(bucket.UpperBound), strconv.Itoa(bucket.Count)})
+	}
+	if err := writeCSV("stabilizationHistogram.csv", stabilizationHistogramHeader, stabilizationHistogramData); err != nil {
+		logrus.Errorln("Unable to write stabilization histogram:", err.Error())
+		return
 	}
-	cpuWriter.Flush()
 
 	return
 }
+
+// Writes a header and the records to a newly created csv file
+func writeCSV(filename string, header []string, records [][]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Divides a by b, returning 0 when there is nothing to average over
+func safeDivide(a, b int) int {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// Formats a histogram bucket bound, using "+Inf" for the overflow bucket
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
+
+/*
+	This function is used to generate logs comparing the emulated lookup latency over
+	exact successor fingers with the latency over proximity fingers, chosen by round
+	trip time among the candidates of each finger interval. Results are saved in
+	proximityPerformance.csv, the improvement is relative to the exact fingers of the
+	same queries.
+*/
+func LogProximityStats() {
+	var proximityHeader []string
+	proximityHeader = append(proximityHeader, "Number of Queries (nQ)")
+	proximityHeader = append(proximityHeader, "Finger Selection")
+	proximityHeader = append(proximityHeader, "Candidates per Finger")
+	proximityHeader = append(proximityHeader, "Average Emulated Latency")
+	proximityHeader = append(proximityHeader, "p50 Emulated Latency")
+	proximityHeader = append(proximityHeader, "p90 Emulated Latency")
+	proximityHeader = append(proximityHeader, "p99 Emulated Latency")
+	proximityHeader = append(proximityHeader, "Average Jump Number")
+	proximityHeader = append(proximityHeader, "Latency Improvement (%)")
+
+	var proximityData [][]string
+	exactMean := 0.0
+	for _, proximityPerformance := range ProximityPerformanceMetrics {
+		latencies := durationSamples(proximityPerformance.Latencies)
+		latency := computePercentiles(latencies)
+		mean, _ := meanStddev(latencies)
+		jumpsMean, _ := meanStddev(intSamples(proximityPerformance.Jumps))
+
+		selection := "proximity"
+		if proximityPerformance.Candidates <= 1 {
+			selection = "exact"
+			exactMean = mean
+		}
+		improvement := 0.0
+		if exactMean > 0 {
+			improvement = 100 * (exactMean - mean) / exactMean
+		}
+
+		var data []string
+		data = append(data, strconv.Itoa(proximityPerformance.NumberOfQueries))
+		data = append(data, selection)
+		data = append(data, strconv.Itoa(proximityPerformance.Candidates))
+		data = append(data, strconv.Itoa(int(mean)))
+		data = append(data, strconv.Itoa(int(latency.P50)))
+		data = append(data, strconv.Itoa(int(latency.P90)))
+		data = append(data, strconv.Itoa(int(latency.P99)))
+		data = append(data, fmt.Sprintf("%f", jumpsMean))
+		data = append(data, fmt.Sprintf("%f", improvement))
+		proximityData = append(proximityData, data)
+	}
+
+	if err := writeCSV("proximityPerformance.csv", proximityHeader, proximityData); err != nil {
+		logrus.Errorln("Unable to write proximity performance:", err.Error())
+	}
+}
+
+/*
+	This function is used to generate logs regarding the message and bandwidth overhead
+	of the run. The RPC counters are reported in total and per vnode per second of the
+	run in rpcPerformance.csv
+*/
+func LogRPCStats(stats map[string]RPCStats, numVnodes int, elapsed time.Duration) {
+	var rpcHeader []string
+	rpcHeader = append(rpcHeader, "RPC")
+	rpcHeader = append(rpcHeader, "Number of Calls")
+	rpcHeader = append(rpcHeader, "Request Bytes")
+	rpcHeader = append(rpcHeader, "Response Bytes")
+	rpcHeader = append(rpcHeader, "Calls per Vnode per Second")
+	rpcHeader = append(rpcHeader, "Bytes per Vnode per Second")
+
+	vnodeSeconds := float64(numVnodes) * elapsed.Seconds()
+	perVnodeSecond := func(v uint64) float64 {
+		if vnodeSeconds == 0 {
+			return 0
+		}
+		return float64(v) / vnodeSeconds
+	}
+
+	var rpcData [][]string
+	total := RPCStats{}
+	for _, rpc := range rpcTypes {
+		s := stats[rpc]
+		total.Calls += s.Calls
+		total.RequestBytes += s.RequestBytes
+		total.ResponseBytes += s.ResponseBytes
+
+		var data []string
+		data = append(data, rpc)
+		data = append(data, strconv.FormatUint(s.Calls, 10))
+		data = append(data, strconv.FormatUint(s.RequestBytes, 10))
+		data = append(data, strconv.FormatUint(s.ResponseBytes, 10))
+		data = append(data, fmt.Sprintf("%f", perVnodeSecond(s.Calls)))
+		data = append(data, fmt.Sprintf("%f", perVnodeSecond(s.RequestBytes+s.ResponseBytes)))
+		rpcData = append(rpcData, data)
+	}
+
+	var data []string
+	data = append(data, "All")
+	data = append(data, strconv.FormatUint(total.Calls, 10))
+	data = append(data, strconv.FormatUint(total.RequestBytes, 10))
+	data = append(data, strconv.FormatUint(total.ResponseBytes, 10))
+	data = append(data, fmt.Sprintf("%f", perVnodeSecond(total.Calls)))
+	data = append(data, fmt.Sprintf("%f", perVnodeSecond(total.RequestBytes+total.ResponseBytes)))
+	rpcData = append(rpcData, data)
+
+	if err := writeCSV("rpcPerformance.csv", rpcHeader, rpcData); err != nil {
+		logrus.Errorln("Unable to write rpc performance:", err.Error())
+	}
+}
@@ -0,0 +1,147 @@
+package chord
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+phiAccrual is an adaptive failure detector (Hayashibara et al., "The φ Accrual
+Failure Detector"). It keeps a window of heartbeat inter-arrival times and
+models them as a normal distribution. Instead of a boolean it reports phi, the
+suspicion that the remote vnode has failed:
+
+	phi = -log10(P(a heartbeat arrives later than now))
+
+so phi = 1 means a 10% chance of a false positive, phi = 2 a 1% chance, and so
+on. On slow or jittery networks the distribution widens and the detector waits
+longer before suspecting a vnode, instead of flapping on a single late reply.
+*/
+type phiAccrual struct {
+	intervals []float64 // Inter-arrival times in seconds, a ring buffer
+	next      int       // Index the next interval is written at
+	last      time.Time // Arrival of the last heartbeat, zero if none
+	bootstrap float64   // Expected interval in seconds, used until one is observed
+}
+
+// Number of inter-arrival times kept per vnode
+const phiWindowSize = 100
+
+// Default phi above which a vnode is considered dead
+const defaultSuspicionThreshold = 8.0
+
+// Creates a detector expecting heartbeats roughly every interval
+func newPhiAccrual(interval time.Duration) *phiAccrual {
+	return &phiAccrual{bootstrap: interval.Seconds()}
+}
+
+// Records the arrival of a heartbeat
+func (p *phiAccrual) heartbeat(now time.Time) {
+	if !p.last.IsZero() {
+		interval := now.Sub(p.last).Seconds()
+		if len(p.intervals) < phiWindowSize {
+			p.intervals = append(p.intervals, interval)
+		} else {
+			p.intervals[p.next] = interval
+		}
+		p.next = (p.next + 1) % phiWindowSize
+	}
+	p.last = now
+}
+
+// Returns whether a heartbeat has ever arrived
+func (p *phiAccrual) seen() bool {
+	return !p.last.IsZero()
+}
+
+// Returns the suspicion level at the given time
+func (p *phiAccrual) phi(now time.Time) float64 {
+	if p.last.IsZero() {
+		return 0
+	}
+	mean, stddev := p.bootstrap, 0.0
+	if len(p.intervals) > 0 {
+		mean, stddev = meanStddev(p.intervals)
+	}
+
+	// Keep a floor on the deviation, perfectly regular heartbeats would
+	// otherwise make the first late one look fatal
+	if min := mean / 4; stddev < min {
+		stddev = min
+	}
+	if stddev <= 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(p.last).Seconds()
+	pLater := 0.5 * math.Erfc((elapsed-mean)/(stddev*math.Sqrt2))
+	if pLater <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log10(pLater)
+}
+
+// Returns the mean and standard deviation of the samples
+func meanStddev(samples []float64) (float64, float64) {
+	sum := 0.0
+	for _, s := range samples {
+		sum += s
+	}
+	mean := sum / float64(len(samples))
+	variance := 0.0
+	for _, s := range samples {
+		variance += (s - mean) * (s - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(samples)))
+}
+
+// Thread safe set of phi accrual detectors, one per remote vnode
+type phiTracker struct {
+	lock      sync.Mutex
+	interval  time.Duration // Expected interval between heartbeats
+	threshold float64       // Phi above which a vnode is dead
+	histories map[string]*phiAccrual
+}
+
+// Creates a tracker for heartbeats expected roughly every interval
+func newPhiTracker(interval time.Duration, threshold float64) *phiTracker {
+	if threshold <= 0 {
+		threshold = defaultSuspicionThreshold
+	}
+	return &phiTracker{interval: interval, threshold: threshold,
+		histories: make(map[string]*phiAccrual)}
+}
+
+// Records a heartbeat from a vnode
+func (t *phiTracker) heartbeat(vn *Vnode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	key := vn.String()
+	p, ok := t.histories[key]
+	if !ok {
+		p = newPhiAccrual(t.interval)
+		t.histories[key] = p
+	}
+	p.heartbeat(now)
+
+	// Forget vnodes that have been silent for long
+	for k, h := range t.histories {
+		if now.Sub(h.last) > phiWindowSize*t.interval {
+			delete(t.histories, k)
+		}
+	}
+}
+
+// Returns whether a vnode is alive by its heartbeat history. Known is false
+// if no heartbeat from it was ever recorded.
+func (t *phiTracker) status(vn *Vnode) (alive bool, known bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.histories[vn.String()]
+	if !ok {
+		return false, false
+	}
+	return p.phi(time.Now()) < t.threshold, true
+}
@@ -0,0 +1,266 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Implemented by transports that measure round trip times
+type RTTProvider interface {
+	// Returns the smoothed round trip time from a local vnode to another
+	// vnode, false if it was never measured
+	RTT(from, to *Vnode) (time.Duration, bool)
+}
+
+// Weight of a new sample in the smoothed round trip time, as in TCP
+const rttSmoothing = 0.125
+
+// Thread safe set of smoothed round trip times, keyed by host
+type rttEstimator struct {
+	lock    sync.Mutex
+	samples map[string]time.Duration
+}
+
+// Records a round trip time sample
+func (e *rttEstimator) sample(key string, rtt time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.samples == nil {
+		e.samples = make(map[string]time.Duration)
+	}
+	srtt, ok := e.samples[key]
+	if !ok {
+		e.samples[key] = rtt
+		return
+	}
+	e.samples[key] = srtt + time.Duration(rttSmoothing*float64(rtt-srtt))
+}
+
+// Returns the smoothed round trip time, false if there is no sample
+func (e *rttEstimator) get(key string) (time.Duration, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	srtt, ok := e.samples[key]
+	return srtt, ok
+}
+
+// Reports whether the response time of a request is a round trip time
+// sample. Requests the remote passes on to other hosts are not.
+func tcpMeasuresRTT(reqType int) bool {
+	switch reqType {
+	case tcpFindSucReq, tcpPingViaReq, tcpFindSucBatchReq:
+		return false
+	}
+	return true
+}
+
+// Returns the smoothed round trip time to the host of a vnode. All vnodes of
+// a host share the network path, so the local vnode does not matter.
+func (t *TCPTransport) RTT(from, to *Vnode) (time.Duration, bool) {
+	return t.rtt.get(to.Host)
+}
+
+// Returns the emulated round trip time if a latency matrix is set. Otherwise
+// local vnodes are reached without a network hop, and the round trip time to
+// remote vnodes is measured by the remote transport.
+func (lt *LocalTransport) RTT(from, to *Vnode) (time.Duration, bool) {
+	lt.lock.RLock()
+	latency := lt.latency
+	lt.lock.RUnlock()
+	if latency != nil {
+		return latency.rtt(from, to)
+	}
+	if _, ok := lt.get(to); ok {
+		return 0, true
+	}
+	if remote, ok := lt.remote.(RTTProvider); ok {
+		return remote.RTT(from, to)
+	}
+	return 0, false
+}
+
+// Emulates the network between the vnodes with a latency matrix, nil for none
+func (lt *LocalTransport) setLatencyMatrix(m LatencyMatrix) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.latency = m
+}
+
+// Emulated round trip times between vnodes, indexed by vnode number
+type LatencyMatrix [][]time.Duration
+
+// Places n vnodes at random points of a plane and sets the round trip time
+// between two of them in proportion to their distance, up to maxRTT, so the
+// emulated latencies obey the triangle inequality like a real network
+func NewLatencyMatrix(n int, maxRTT time.Duration) LatencyMatrix {
+	x := make([]float64, n)
+	y := make([]float64, n)
+	for i := 0; i < n; i++ {
+		x[i], y[i] = rand.Float64(), rand.Float64()
+	}
+	m := make(LatencyMatrix, n)
+	for i := 0; i < n; i++ {
+		m[i] = make([]time.Duration, n)
+		for j := 0; j < n; j++ {
+			dist := math.Hypot(x[i]-x[j], y[i]-y[j]) / math.Sqrt2
+			m[i][j] = time.Duration(dist * float64(maxRTT))
+		}
+	}
+	return m
+}
+
+// Returns the emulated round trip time between two vnodes
+func (m LatencyMatrix) rtt(from, to *Vnode) (time.Duration, bool) {
+	if from.Num < 0 || from.Num >= len(m) || to.Num < 0 || to.Num >= len(m) {
+		return 0, false
+	}
+	return m[from.Num][to.Num], true
+}
+
+// Number of candidates considered for a finger, at least one
+func (vn *localVnode) fingerCandidates() int {
+	n := vn.ring.config.ProximityCandidates
+	if vn.candidates > 0 {
+		n = vn.candidates
+	}
+	if n > vn.ring.config.NumSuccessors {
+		n = vn.ring.config.NumSuccessors
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Picks the finger among the candidates with the lowest round trip time. The
+// first candidate is the exact successor of the start of the finger interval,
+// the others are only considered while they lie before its end, a nil end
+// meaning the interval reaches back to us. Candidates that were never
+// measured are pinged once to collect a sample.
+func (vn *localVnode) nearestCandidate(candidates []*Vnode, end []byte) *Vnode {
+	best := candidates[0]
+	provider, ok := vn.ring.transport.(RTTProvider)
+	if !ok || len(candidates) == 1 {
+		return best
+	}
+	bestRTT, known := vn.sampleRTT(provider, best)
+	for _, c := range candidates[1:] {
+		if c == nil || bytes.Equal(c.Id, vn.Id) {
+			break
+		}
+		if end != nil && !global.Between(vn.Id, end, c.Id) {
+			break
+		}
+		rtt, ok := vn.sampleRTT(provider, c)
+		if ok && (!known || rtt < bestRTT) {
+			best, bestRTT, known = c, rtt, true
+		}
+	}
+	return best
+}
+
+// Returns the round trip time to a vnode, pinging it if there is no sample yet
+func (vn *localVnode) sampleRTT(provider RTTProvider, to *Vnode) (time.Duration, bool) {
+	if rtt, ok := provider.RTT(&vn.Vnode, to); ok {
+		return rtt, true
+	}
+	if _, err := vn.ring.transport.Ping(to); err != nil {
+		return 0, false
+	}
+	return provider.RTT(&vn.Vnode, to)
+}
+
+// A request to rebuild the finger table of a vnode
+type fingerRebuild struct {
+	candidates int           // Candidates per finger, 0 for ProximityCandidates
+	done       chan struct{} // Closed once the table is rebuilt
+}
+
+// Rebuilds the whole finger table, considering the given number of candidates
+// per finger from now on. Only called by stabilize, which owns the fingers.
+func (vn *localVnode) rebuildFingers(candidates int) {
+	vn.candidates = candidates
+	vn.last_finger = 0
+	for {
+		// Stop once the table wrapped around, or when a finger could not be
+		// fixed and the index did not move on
+		prev := vn.last_finger
+		vn.fixFingerTable()
+		if vn.last_finger == 0 || vn.last_finger == prev {
+			break
+		}
+	}
+}
+
+// Rebuilds the finger table of every local vnode, considering the given
+// number of candidates per finger, 0 for ProximityCandidates. Each rebuild
+// runs in the next stabilize of its vnode, which is waited for.
+func (r *Ring) rebuildFingers(candidates int) {
+	vnodes := r.localVnodes()
+	var pending []chan struct{}
+	for _, vn := range vnodes {
+		if vn == nil || vn.Shutdown {
+			continue
+		}
+		// Replace a request that was never picked up
+		select {
+		case <-vn.rebuild:
+		default:
+		}
+		req := fingerRebuild{candidates: candidates, done: make(chan struct{})}
+		vn.rebuild <- req
+		pending = append(pending, req.done)
+	}
+
+	timeout := time.After(2 * r.config.StabilizeMax)
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-timeout:
+			log.Printf("[ERR] Timed out waiting for the finger tables to be rebuilt")
+			return
+		}
+	}
+}
+
+// Follows the recursive routing of a lookup through the local vnodes and sums
+// the emulated round trip time of each hop. Returns the latency and the jump
+// number, counted as by FindSuccessors.
+func (r *Ring) emulatedLookup(m LatencyMatrix, origin *localVnode, key []byte) (time.Duration, int) {
+	lt, ok := r.transport.(*LocalTransport)
+	if !ok {
+		return 0, 0
+	}
+	vn := origin
+	total := time.Duration(0)
+	jumps := 1
+	for ; jumps <= r.config.hashBits; jumps++ {
+		succ := vn.successors[0]
+		if succ == nil || bytes.Equal(key, vn.Id) || global.BetweenRightIncl(vn.Id, succ.Id, key) {
+			break
+		}
+
+		// Forward to the closest preceding vnode that is still registered
+		var next *localVnode
+		cp := closestPreceedingVnodeIterator{}
+		cp.init(vn, key)
+		for next == nil {
+			closest, _ := cp.Next()
+			if closest == nil {
+				return total, jumps
+			}
+			if obj, ok := lt.get(closest); ok {
+				next, _ = obj.(*localVnode)
+			}
+		}
+		rtt, _ := m.rtt(&vn.Vnode, &next.Vnode)
+		total += rtt
+		vn = next
+	}
+	return total, jumps
+}
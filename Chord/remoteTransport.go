@@ -1,7 +1,9 @@
 package chord
 
 import (
-	"encoding/gob"
+	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -14,31 +16,74 @@ import (
 TCPTransport provides a TCP based Chord transport layer. This allows Chord
 to be implemented over a network, instead of only using the LocalTransport. It is
 meant to be a simple implementation, optimizing for simplicity instead of performance.
-Messages are sent with a header frame, followed by a body frame. All data is encoded
-using the GOB format for simplicity.
+Every connection starts with a handshake that negotiates the protocol version, after
+which each message is sent as a single length prefixed frame with an explicit binary
+schema, so that nodes of different builds and non-Go tooling can interoperate. The
+format is described in wire.go and in the README.
+
+Connections are multiplexed. Every request frame carries a request ID which is
+echoed in the frame of its response, so many RPCs can be in flight on a single
+connection and responses may arrive in any order. At most maxConns connections
+are opened to each host; a new connection is only dialed when all the existing
+ones have requests in flight.
 
 Internally, there is 1 Goroutine listening for inbound connections, 1 Goroutine PER
-inbound connection.
+inbound connection reading requests, 1 Goroutine PER inbound request handling it,
+and 1 Goroutine PER outbound connection reading responses.
 */
 type TCPTransport struct {
-	sock     *net.TCPListener
-	timeout  time.Duration
-	maxIdle  time.Duration
-	lock     sync.RWMutex
-	local    map[string]*localRPC
-	inbound  map[*net.TCPConn]struct{}
-	poolLock sync.Mutex
-	pool     map[string][]*tcpOutConn
-	shutdown int32
+	sock              *net.TCPListener
+	timeout           time.Duration
+	maxIdle           time.Duration
+	maxConns          int
+	tlsServer         *tls.Config // TLS configuration of inbound connections, nil for plaintext
+	tlsClient         *tls.Config // TLS configuration of outbound connections, nil for plaintext
+	lock              sync.RWMutex
+	local             map[string]*localRPC
+	inbound           map[net.Conn]struct{}
+	poolLock          sync.Mutex
+	pool              map[string][]*tcpOutConn
+	shutdown          int32
+	stats             rpcCounters
+	rtt               rttEstimator // Smoothed round trip times, keyed by host
+	breakerLock       sync.Mutex
+	breakers          map[string]*hostBreaker // Circuit breakers of hosts that have failed
+	breakerThreshold  int
+	breakerBackoff    time.Duration
+	breakerMaxBackoff time.Duration
+	identity          *ringIdentity               // Ring identity messages are sealed with, nil for none
+	rejected          func(remote, ringID string) // Reports messages from foreign rings
+	verifyHosts       bool                        // Checks sending vnodes against peer certificates
 }
 
+// Default bound on the number of outbound connections per host
+const defaultMaxConnsPerHost = 2
+
 type tcpOutConn struct {
-	host   string
-	sock   *net.TCPConn
-	header tcpHeader
-	enc    *gob.Encoder
-	dec    *gob.Decoder
-	used   time.Time
+	host    string
+	sock    net.Conn
+	reader  *bufio.Reader
+	version uint16 // Negotiated protocol version
+	ident   *ringIdentity
+	nonce   []byte     // Session nonce the HMAC is bound to, from version 7
+	encLock sync.Mutex // Serializes requests on the connection
+	lock    sync.Mutex // Guards pending, nextID and err
+	pending map[uint64]*tcpPending
+	nextID  uint64
+	err     error // Set once the connection has failed
+	used    time.Time
+}
+
+// An RPC waiting for its response
+type tcpPending struct {
+	reqType int // Type of the request, the response must answer it
+	done    chan tcpResult
+}
+
+type tcpResult struct {
+	body      wireMessage
+	respBytes int
+	err       error
 }
 
 const (
@@ -49,12 +94,11 @@ const (
 	tcpFindSucReq
 	tcpClearPredReq
 	tcpSkipSucReq
+	tcpPingViaReq
+	tcpClosestPrecReq
+	tcpFindSucBatchReq
 )
 
-type tcpHeader struct {
-	ReqType int
-}
-
 // Potential body types
 type tcpBodyError struct {
 	Err error
@@ -74,6 +118,11 @@ type tcpBodyFindSuc struct {
 	Num    int
 	Key    []byte
 }
+type tcpBodyFindSucBatch struct {
+	Target *Vnode
+	Num    int
+	Keys   [][]byte
+}
 type tcpBodyVnodeError struct {
 	Vnode *Vnode
 	Err   error
@@ -82,14 +131,255 @@ type tcpBodyVnodeListError struct {
 	Vnodes []*Vnode
 	Err    error
 }
+type tcpBodyTwoVnodeListError struct {
+	Vnodes []*Vnode
+	Next   []*Vnode
+	Err    error
+}
+type tcpBodyVnodeListsError struct {
+	Lists [][]*Vnode
+	Err   error
+}
 type tcpBodyBoolError struct {
 	B   bool
 	Err error
 }
 
+// Message schemas, fields are encoded in the order listed
+func (b *tcpBodyError) encode(w *wireWriter) {
+	w.putError(b.Err)
+}
+func (b *tcpBodyError) decode(r *wireReader) {
+	b.Err = r.getError()
+}
+
+func (b *tcpBodyString) encode(w *wireWriter) {
+	w.putString(b.S)
+}
+func (b *tcpBodyString) decode(r *wireReader) {
+	b.S = r.getString()
+}
+
+func (b *tcpBodyVnode) encode(w *wireWriter) {
+	w.putVnode(b.Vn)
+}
+func (b *tcpBodyVnode) decode(r *wireReader) {
+	b.Vn = r.getVnode()
+}
+
+func (b *tcpBodyTwoVnode) encode(w *wireWriter) {
+	w.putVnode(b.Target)
+	w.putVnode(b.Vn)
+}
+func (b *tcpBodyTwoVnode) decode(r *wireReader) {
+	b.Target = r.getVnode()
+	b.Vn = r.getVnode()
+}
+
+func (b *tcpBodyFindSuc) encode(w *wireWriter) {
+	w.putVnode(b.Target)
+	w.putUint32(uint32(b.Num))
+	w.putBytes(b.Key)
+}
+func (b *tcpBodyFindSuc) decode(r *wireReader) {
+	b.Target = r.getVnode()
+	b.Num = int(r.getUint32())
+	b.Key = r.getBytes()
+}
+
+func (b *tcpBodyFindSucBatch) encode(w *wireWriter) {
+	w.putVnode(b.Target)
+	w.putUint32(uint32(b.Num))
+	w.putKeys(b.Keys)
+}
+func (b *tcpBodyFindSucBatch) decode(r *wireReader) {
+	b.Target = r.getVnode()
+	b.Num = int(r.getUint32())
+	b.Keys = r.getKeys()
+}
+
+func (b *tcpBodyVnodeError) encode(w *wireWriter) {
+	w.putVnode(b.Vnode)
+	w.putError(b.Err)
+}
+func (b *tcpBodyVnodeError) decode(r *wireReader) {
+	b.Vnode = r.getVnode()
+	b.Err = r.getError()
+}
+
+func (b *tcpBodyVnodeListError) encode(w *wireWriter) {
+	w.putVnodes(b.Vnodes)
+	w.putError(b.Err)
+}
+func (b *tcpBodyVnodeListError) decode(r *wireReader) {
+	b.Vnodes = r.getVnodes()
+	b.Err = r.getError()
+}
+
+func (b *tcpBodyTwoVnodeListError) encode(w *wireWriter) {
+	w.putVnodes(b.Vnodes)
+	w.putVnodes(b.Next)
+	w.putError(b.Err)
+}
+func (b *tcpBodyTwoVnodeListError) decode(r *wireReader) {
+	b.Vnodes = r.getVnodes()
+	b.Next = r.getVnodes()
+	b.Err = r.getError()
+}
+
+func (b *tcpBodyVnodeListsError) encode(w *wireWriter) {
+	w.putVnodeLists(b.Lists)
+	w.putError(b.Err)
+}
+func (b *tcpBodyVnodeListsError) decode(r *wireReader) {
+	b.Lists = r.getVnodeLists()
+	b.Err = r.getError()
+}
+
+func (b *tcpBodyBoolError) encode(w *wireWriter) {
+	w.putBool(b.B)
+	w.putError(b.Err)
+}
+func (b *tcpBodyBoolError) decode(r *wireReader) {
+	b.B = r.getBool()
+	b.Err = r.getError()
+}
+
+// Allocates the body of a request of the given type
+func newTcpRequest(reqType int) wireMessage {
+	switch reqType {
+	case tcpPing, tcpGetPredReq:
+		return &tcpBodyVnode{}
+	case tcpListReq:
+		return &tcpBodyString{}
+	case tcpNotifyReq, tcpClearPredReq, tcpSkipSucReq, tcpPingViaReq:
+		return &tcpBodyTwoVnode{}
+	case tcpFindSucReq, tcpClosestPrecReq:
+		return &tcpBodyFindSuc{}
+	case tcpFindSucBatchReq:
+		return &tcpBodyFindSucBatch{}
+	}
+	return nil
+}
+
+// Returns the first protocol version that knows a request type
+func tcpRequestVersion(reqType int) uint16 {
+	switch reqType {
+	case tcpPingViaReq:
+		return tcpPingViaVersion
+	case tcpClosestPrecReq:
+		return tcpClosestPrecedingVersion
+	case tcpFindSucBatchReq:
+		return tcpBatchVersion
+	}
+	return tcpMinProtocolVersion
+}
+
+// Allocates the body of the response to a request of the given type
+func newTcpResponse(reqType int) wireMessage {
+	switch reqType {
+	case tcpPing, tcpPingViaReq:
+		return &tcpBodyBoolError{}
+	case tcpListReq, tcpNotifyReq, tcpFindSucReq:
+		return &tcpBodyVnodeListError{}
+	case tcpGetPredReq:
+		return &tcpBodyVnodeError{}
+	case tcpClearPredReq, tcpSkipSucReq:
+		return &tcpBodyError{}
+	case tcpClosestPrecReq:
+		return &tcpBodyTwoVnodeListError{}
+	case tcpFindSucBatchReq:
+		return &tcpBodyVnodeListsError{}
+	}
+	return nil
+}
+
+// Returns the error for a response body of the wrong type
+func unexpectedResponse(reqType int, body wireMessage) error {
+	return fmt.Errorf("Unexpected response to %s! Got %T", tcpRPCName(reqType), body)
+}
+
+// Builds the response to a request of the given type that failed with err
+func errorResponse(reqType int, err error) wireMessage {
+	resp := newTcpResponse(reqType)
+	switch r := resp.(type) {
+	case *tcpBodyBoolError:
+		r.Err = err
+	case *tcpBodyVnodeListError:
+		r.Err = err
+	case *tcpBodyVnodeError:
+		r.Err = err
+	case *tcpBodyError:
+		r.Err = err
+	case *tcpBodyTwoVnodeListError:
+		r.Err = err
+	case *tcpBodyVnodeListsError:
+		r.Err = err
+	}
+	return resp
+}
+
+// Checks the fields of a decoded request that the handlers rely on. Vnodes
+// encoded as absent are rejected, as are requests for no successors.
+func validateRequest(reqType int, reqBody wireMessage) error {
+	var vnodes []*Vnode
+	num := 1
+	switch body := reqBody.(type) {
+	case *tcpBodyVnode:
+		vnodes = []*Vnode{body.Vn}
+	case *tcpBodyTwoVnode:
+		vnodes = []*Vnode{body.Target, body.Vn}
+	case *tcpBodyFindSuc:
+		vnodes, num = []*Vnode{body.Target}, body.Num
+	case *tcpBodyFindSucBatch:
+		vnodes, num = []*Vnode{body.Target}, body.Num
+	}
+	for _, vn := range vnodes {
+		if vn == nil {
+			return fmt.Errorf("%w Request type %d is missing a vnode", ErrInvalidRequest, reqType)
+		}
+	}
+	if num < 1 {
+		return fmt.Errorf("%w Request type %d asks for %d successors", ErrInvalidRequest, reqType, num)
+	}
+	return nil
+}
+
+// Returns the name an RPC of the given type is counted under
+func tcpRPCName(reqType int) string {
+	switch reqType {
+	case tcpPing:
+		return rpcPing
+	case tcpListReq:
+		return rpcListVnodes
+	case tcpGetPredReq:
+		return rpcGetPredecessor
+	case tcpNotifyReq:
+		return rpcNotify
+	case tcpFindSucReq:
+		return rpcFindSuccessors
+	case tcpClearPredReq:
+		return rpcClearPredecessor
+	case tcpSkipSucReq:
+		return rpcSkipSuccessor
+	case tcpPingViaReq:
+		return rpcPingVia
+	case tcpClosestPrecReq:
+		return rpcClosestPreceding
+	case tcpFindSucBatchReq:
+		return rpcFindSuccessorsBatch
+	}
+	return ""
+}
+
 // Creates a new TCP transport on the given listen address with the
 // configured timeout duration.
 func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, error) {
+	return initTCPTransport(listen, timeout, nil, nil)
+}
+
+// Creates a TCP transport, using TLS when the configurations are given
+func initTCPTransport(listen string, timeout time.Duration, tlsServer, tlsClient *tls.Config) (*TCPTransport, error) {
 	// Try to start the listener
 	sock, err := net.Listen("tcp", listen)
 	if err != nil {
@@ -98,7 +388,7 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 
 	// allocate maps
 	local := make(map[string]*localRPC)
-	inbound := make(map[*net.TCPConn]struct{})
+	inbound := make(map[net.Conn]struct{})
 	pool := make(map[string][]*tcpOutConn)
 
 	// Maximum age of a connection
@@ -106,11 +396,18 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 
 	// Setup the transport
 	tcp := &TCPTransport{sock: sock.(*net.TCPListener),
-		timeout: timeout,
-		maxIdle: maxIdle,
-		local:   local,
-		inbound: inbound,
-		pool:    pool}
+		timeout:           timeout,
+		maxIdle:           maxIdle,
+		maxConns:          defaultMaxConnsPerHost,
+		tlsServer:         tlsServer,
+		tlsClient:         tlsClient,
+		local:             local,
+		inbound:           inbound,
+		pool:              pool,
+		breakers:          make(map[string]*hostBreaker),
+		breakerThreshold:  defaultBreakerThreshold,
+		breakerBackoff:    defaultBreakerBackoff,
+		breakerMaxBackoff: defaultBreakerMaxBackoff}
 
 	// Listen for connections
 	go tcp.listen()
@@ -122,6 +419,43 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	return tcp, nil
 }
 
+// Sets the maximum number of outbound connections opened to each host
+func (t *TCPTransport) SetMaxConnsPerHost(n int) {
+	if n < 1 {
+		n = 1
+	}
+	t.poolLock.Lock()
+	t.maxConns = n
+	t.poolLock.Unlock()
+}
+
+// Sets the ring identity that every message must carry. Peers that are too
+// old to seal their messages are rejected once an identity is set.
+func (t *TCPTransport) SetRingIdentity(ringID string, secret []byte, rejected func(remote, ringID string)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.identity = &ringIdentity{id: ringID, secret: secret}
+	t.rejected = rejected
+}
+
+// Returns the ring identity, nil if none is set
+func (t *TCPTransport) ringIdentity() *ringIdentity {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.identity
+}
+
+// Reports a message from a foreign ring
+func (t *TCPTransport) reject(remote, ringID string, err error) {
+	log.Printf("[ERR] Rejected TCP message from %s! Got %s", remote, err)
+	t.lock.RLock()
+	rejected := t.rejected
+	t.lock.RUnlock()
+	if rejected != nil {
+		rejected(remote, ringID)
+	}
+}
+
 // Checks for a local vnode
 func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
 	key := vn.String()
@@ -135,419 +469,390 @@ func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
 	}
 }
 
-// Gets an outbound connection to a host
+// Gets an outbound connection to a host. The least loaded connection is
+// shared, unless every connection is busy and the bound allows another.
 func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	// Check if we have a conn cached
-	var out *tcpOutConn
 	t.poolLock.Lock()
 	if atomic.LoadInt32(&t.shutdown) == 1 {
 		t.poolLock.Unlock()
-		return nil, fmt.Errorf("TCP transport is shutdown")
+		return nil, ErrShuttingDown
 	}
-	list, ok := t.pool[host]
-	if ok && len(list) > 0 {
-		out = list[len(list)-1]
-		list = list[:len(list)-1]
-		t.pool[host] = list
+	best := leastLoaded(t.pool[host])
+	if best != nil && (best.inFlight() == 0 || len(t.pool[host]) >= t.maxConns) {
+		best.used = time.Now()
+		t.poolLock.Unlock()
+		return best, nil
 	}
 	t.poolLock.Unlock()
-	if out != nil {
-		// Verify that the socket is valid. Might be closed.
-		if _, err := out.sock.Read(nil); err == nil {
-			return out, nil
-		}
-		out.sock.Close()
-	}
 
 	// Try to establish a connection
 	conn, err := net.DialTimeout("tcp", host, t.timeout)
 	if err != nil {
+		if best != nil {
+			return best, nil
+		}
 		return nil, err
 	}
 
 	// Setup the socket
-	sock := conn.(*net.TCPConn)
-	t.setupConn(sock)
-	enc := gob.NewEncoder(sock)
-	dec := gob.NewDecoder(sock)
+	var sock net.Conn = conn
+	t.setupConn(conn.(*net.TCPConn))
+	if t.tlsClient != nil {
+		if sock, err = t.clientTLS(conn, host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	reader := bufio.NewReader(sock)
+
+	// Negotiate the protocol version
+	sock.SetDeadline(time.Now().Add(t.timeout))
+	if err := writeHello(sock); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	version, err := readWelcome(reader)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	var nonce []byte
+	if version >= tcpNonceVersion {
+		if nonce, err = exchangeNonces(sock, reader, false); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	sock.SetDeadline(time.Time{})
 	now := time.Now()
 
+	// Peers that cannot seal their messages cannot prove their ring
+	ident := t.ringIdentity()
+	if ident != nil && version < ident.minVersion() {
+		sock.Close()
+		err := fmt.Errorf("%w Peer speaks version %d, the ring identity needs %d", ErrForeignRing,
+			version, ident.minVersion())
+		t.reject(host, "", err)
+		return nil, err
+	}
+
 	// Wrap the sock
-	out = &tcpOutConn{host: host, sock: sock, enc: enc, dec: dec, used: now}
+	out := &tcpOutConn{host: host, sock: sock, reader: reader, version: version,
+		ident: ident, nonce: nonce, pending: make(map[uint64]*tcpPending), used: now}
+
+	// Add it to the pool, unless others raced us past the bound
+	t.poolLock.Lock()
+	if atomic.LoadInt32(&t.shutdown) == 1 {
+		t.poolLock.Unlock()
+		sock.Close()
+		return nil, ErrShuttingDown
+	}
+	if len(t.pool[host]) >= t.maxConns {
+		best = leastLoaded(t.pool[host])
+		best.used = now
+		t.poolLock.Unlock()
+		sock.Close()
+		return best, nil
+	}
+	t.pool[host] = append(t.pool[host], out)
+	t.poolLock.Unlock()
+
+	// Read the responses
+	go t.readResponses(out)
 	return out, nil
 }
 
-// Returns an outbound TCP connection to the pool
-func (t *TCPTransport) returnConn(o *tcpOutConn) {
-	// Update the last used time
-	o.used = time.Now()
+// Returns the connection with the fewest requests in flight
+func leastLoaded(conns []*tcpOutConn) *tcpOutConn {
+	var best *tcpOutConn
+	bestLoad := 0
+	for _, out := range conns {
+		load := out.inFlight()
+		if best == nil || load < bestLoad {
+			best, bestLoad = out, load
+		}
+	}
+	return best
+}
 
-	// Push back into the pool
-	t.poolLock.Lock()
-	defer t.poolLock.Unlock()
-	if atomic.LoadInt32(&t.shutdown) == 1 {
-		o.sock.Close()
-		return
+// Returns the number of requests waiting for a response
+func (o *tcpOutConn) inFlight() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.pending)
+}
+
+// Registers a pending request and returns its ID
+func (o *tcpOutConn) register(p *tcpPending) (uint64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.err != nil {
+		return 0, o.err
 	}
-	list, _ := t.pool[o.host]
-	t.pool[o.host] = append(list, o)
+	o.nextID++
+	o.pending[o.nextID] = p
+	return o.nextID, nil
 }
 
-// Setup a connection
-func (t *TCPTransport) setupConn(c *net.TCPConn) {
-	c.SetNoDelay(true)
-	c.SetKeepAlive(true)
+// Removes and returns the pending request with the given ID
+func (o *tcpOutConn) complete(id uint64) *tcpPending {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	p := o.pending[id]
+	delete(o.pending, id)
+	return p
 }
 
-// Gets a list of the vnodes on the box
-func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
-	// Get a conn
-	out, err := t.getConn(host)
-	if err != nil {
-		return nil, err
+// Closes an outbound connection, failing all requests in flight on it
+func (t *TCPTransport) closeConn(o *tcpOutConn, err error) {
+	o.lock.Lock()
+	if o.err == nil {
+		o.err = err
 	}
+	pending := o.pending
+	o.pending = make(map[uint64]*tcpPending)
+	o.lock.Unlock()
+	o.sock.Close()
 
-	// Response channels
-	respChan := make(chan []*Vnode, 1)
-	errChan := make(chan error, 1)
+	for _, p := range pending {
+		p.done <- tcpResult{err: err}
+	}
+
+	// Remove from the pool
+	t.poolLock.Lock()
+	defer t.poolLock.Unlock()
+	conns := t.pool[o.host]
+	for i, out := range conns {
+		if out == o {
+			t.pool[o.host] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+}
 
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpListReq
-		body := tcpBodyString{S: host}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
+// Reads responses off an outbound connection and hands them to the pending requests
+func (t *TCPTransport) readResponses(out *tcpOutConn) {
+	for {
+		msgType, reqID, payload, size, err := readFrame(out.reader)
+		if err != nil {
+			t.closeConn(out, err)
 			return
 		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
+		if msgType&tcpRespFlag == 0 || newTcpResponse(int(msgType&^tcpRespFlag)) == nil {
+			t.closeConn(out, fmt.Errorf("Unknown response type! Got %d", msgType))
 			return
 		}
 
-		// Read in the response
-		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
+		// Requests that timed out are no longer pending, drop their response
+		p := out.complete(reqID)
+		if p == nil {
+			continue
 		}
 
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- resp.Vnodes
-		} else {
-			errChan <- resp.Err
+		// The body is decoded as the response to what was asked, a peer
+		// answering with another type fails the request
+		if respType := int(msgType &^ tcpRespFlag); respType != p.reqType {
+			p.done <- tcpResult{err: fmt.Errorf("%s answered with a %s response!",
+				tcpRPCName(p.reqType), tcpRPCName(respType))}
+			continue
 		}
-	}()
+		resp := newTcpResponse(p.reqType)
+		if out.version >= tcpIdentityVersion {
+			var ringID string
+			payload, ringID, err = out.ident.open(out.nonce, msgType, reqID, payload)
+			if errors.Is(err, ErrForeignRing) {
+				t.reject(out.host, ringID, err)
+				p.done <- tcpResult{err: err}
+				continue
+			} else if err != nil {
+				p.done <- tcpResult{err: fmt.Errorf("Failed to open TCP envelope! Got %s", err)}
+				continue
+			}
+		}
+		if err := decodeMessage(payload, resp, out.version); err != nil {
+			p.done <- tcpResult{err: fmt.Errorf("Failed to decode TCP body! Got %s", err)}
+			continue
+		}
+		p.done <- tcpResult{body: resp, respBytes: size}
+	}
+}
 
-	select {
-	case <-time.After(t.timeout):
-		return nil, fmt.Errorf("Command timed out!")
-	case err := <-errChan:
+// Sends a request to a host and waits for the response body. Hosts whose
+// circuit breaker is open are failed fast without being contacted.
+func (t *TCPTransport) call(host string, reqType int, body wireMessage) (wireMessage, error) {
+	if err := t.breakerAllow(host); err != nil {
 		return nil, err
-	case res := <-respChan:
-		return res, nil
 	}
+	resp, err := t.roundTrip(host, reqType, body)
+	t.breakerRecord(host, err)
+	return resp, err
 }
 
-// Ping a Vnode, check for liveness
-func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
+// Sends a request over a pooled connection and waits for the response body
+func (t *TCPTransport) roundTrip(host string, reqType int, body wireMessage) (wireMessage, error) {
 	// Get a conn
-	out, err := t.getConn(vn.Host)
+	out, err := t.getConn(host)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if need := tcpRequestVersion(reqType); out.version < need {
+		return nil, fmt.Errorf("%w %s needs version %d, peer speaks %d", ErrProtocolMismatch,
+			tcpRPCName(reqType), need, out.version)
 	}
 
-	// Response channels
-	respChan := make(chan bool, 1)
-	errChan := make(chan error, 1)
+	p := &tcpPending{reqType: reqType, done: make(chan tcpResult, 1)}
+	id, err := out.register(p)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpPing
-		body := tcpBodyVnode{Vn: vn}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
+	// Send the request
+	payload := encodeMessage(body, out.version)
+	if out.version >= tcpIdentityVersion {
+		payload = out.ident.seal(out.nonce, uint8(reqType), id, payload)
+	}
+	sent := time.Now()
+	out.encLock.Lock()
+	out.sock.SetWriteDeadline(time.Now().Add(t.timeout))
+	reqBytes, err := writeFrame(out.sock, uint8(reqType), id, payload)
+	out.encLock.Unlock()
+	if err != nil {
+		t.closeConn(out, err)
+		return nil, err
+	}
+
+	select {
+	case <-time.After(t.timeout):
+		out.complete(id)
+		return nil, ErrTimeout
+	case res := <-p.done:
+		if res.err != nil {
+			return nil, res.err
 		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
+		t.stats.record(tcpRPCName(reqType), reqBytes, res.respBytes)
+		if tcpMeasuresRTT(reqType) {
+			t.rtt.sample(host, time.Since(sent))
 		}
+		return res.body, nil
+	}
+}
 
-		// Read in the response
-		resp := tcpBodyBoolError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
+// Returns a copy of the counters of the RPCs sent by this transport
+func (t *TCPTransport) RPCStats() map[string]RPCStats {
+	return t.stats.snapshot()
+}
 
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- resp.B
-		} else {
-			errChan <- resp.Err
-		}
-	}()
+// Setup a connection
+func (t *TCPTransport) setupConn(c *net.TCPConn) {
+	c.SetNoDelay(true)
+	c.SetKeepAlive(true)
+}
 
-	select {
-	case <-time.After(t.timeout):
-		return false, fmt.Errorf("Command timed out!")
-	case err := <-errChan:
+// Gets a list of the vnodes on the box
+func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
+	body, err := t.call(host, tcpListReq, &tcpBodyString{S: host})
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := body.(*tcpBodyVnodeListError)
+	if !ok {
+		return nil, unexpectedResponse(tcpListReq, body)
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Vnodes, nil
+}
+
+// Ping a Vnode, check for liveness
+func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
+	body, err := t.call(vn.Host, tcpPing, &tcpBodyVnode{Vn: vn})
+	if err != nil {
 		return false, err
-	case res := <-respChan:
-		return res, nil
 	}
+	resp, ok := body.(*tcpBodyBoolError)
+	if !ok {
+		return false, unexpectedResponse(tcpPing, body)
+	}
+	if resp.Err != nil {
+		return false, resp.Err
+	}
+	return resp.B, nil
 }
 
 // Request a nodes predecessor
 func (t *TCPTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
-	// Get a conn
-	out, err := t.getConn(vn.Host)
+	body, err := t.call(vn.Host, tcpGetPredReq, &tcpBodyVnode{Vn: vn})
 	if err != nil {
 		return nil, err
 	}
-
-	respChan := make(chan *Vnode, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpGetPredReq
-		body := tcpBodyVnode{Vn: vn}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Read in the response
-		resp := tcpBodyVnodeError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- resp.Vnode
-		} else {
-			errChan <- resp.Err
-		}
-	}()
-
-	select {
-	case <-time.After(t.timeout):
-		return nil, fmt.Errorf("Command timed out!")
-	case err := <-errChan:
-		return nil, err
-	case res := <-respChan:
-		return res, nil
+	resp, ok := body.(*tcpBodyVnodeError)
+	if !ok {
+		return nil, unexpectedResponse(tcpGetPredReq, body)
 	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp.Vnode, nil
 }
 
 // Notify our successor of ourselves
 func (t *TCPTransport) Notify(target, self *Vnode) ([]*Vnode, error) {
-	// Get a conn
-	out, err := t.getConn(target.Host)
+	body, err := t.call(target.Host, tcpNotifyReq, &tcpBodyTwoVnode{Target: target, Vn: self})
 	if err != nil {
 		return nil, err
 	}
-
-	respChan := make(chan []*Vnode, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpNotifyReq
-		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Read in the response
-		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- resp.Vnodes
-		} else {
-			errChan <- resp.Err
-		}
-	}()
-
-	select {
-	case <-time.After(t.timeout):
-		return nil, fmt.Errorf("Command timed out!")
-	case err := <-errChan:
-		return nil, err
-	case res := <-respChan:
-		return res, nil
+	resp, ok := body.(*tcpBodyVnodeListError)
+	if !ok {
+		return nil, unexpectedResponse(tcpNotifyReq, body)
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
 	}
+	return resp.Vnodes, nil
 }
 
 // Find a successor
 func (t *TCPTransport) FindSuccessors(vn *Vnode, n int, k []byte) ([]*Vnode, int, int, error) {
-	// Get a conn
-	out, err := t.getConn(vn.Host)
+	body, err := t.call(vn.Host, tcpFindSucReq, &tcpBodyFindSuc{Target: vn, Num: n, Key: k})
 	if err != nil {
 		return nil, 0, 0, err
 	}
-
-	respChan := make(chan []*Vnode, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpFindSucReq
-		body := tcpBodyFindSuc{Target: vn, Num: n, Key: k}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Read in the response
-		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- resp.Vnodes
-		} else {
-			errChan <- resp.Err
-		}
-	}()
-
-	select {
-	case <-time.After(t.timeout):
-		return nil, 0, 0, fmt.Errorf("Command timed out!")
-	case err := <-errChan:
-		return nil, 0, 0, err
-	case res := <-respChan:
-		return res, 0, 0, nil
+	resp, ok := body.(*tcpBodyVnodeListError)
+	if !ok {
+		return nil, 0, 0, unexpectedResponse(tcpFindSucReq, body)
+	}
+	if resp.Err != nil {
+		return nil, 0, 0, resp.Err
 	}
+	return resp.Vnodes, 0, 0, nil
 }
 
 // Clears a predecessor if it matches a given vnode. Used to leave.
 func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
-	// Get a conn
-	out, err := t.getConn(target.Host)
+	body, err := t.call(target.Host, tcpClearPredReq, &tcpBodyTwoVnode{Target: target, Vn: self})
 	if err != nil {
 		return err
 	}
-
-	respChan := make(chan bool, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpClearPredReq
-		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Read in the response
-		resp := tcpBodyError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- true
-		} else {
-			errChan <- resp.Err
-		}
-	}()
-
-	select {
-	case <-time.After(t.timeout):
-		return fmt.Errorf("Command timed out!")
-	case err := <-errChan:
-		return err
-	case <-respChan:
-		return nil
+	resp, ok := body.(*tcpBodyError)
+	if !ok {
+		return unexpectedResponse(tcpClearPredReq, body)
 	}
+	return resp.Err
 }
 
 // Instructs a node to skip a given successor. Used to leave.
 func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
-	// Get a conn
-	out, err := t.getConn(target.Host)
+	body, err := t.call(target.Host, tcpSkipSucReq, &tcpBodyTwoVnode{Target: target, Vn: self})
 	if err != nil {
 		return err
 	}
-
-	respChan := make(chan bool, 1)
-	errChan := make(chan error, 1)
-
-	go func() {
-		// Send a list command
-		out.header.ReqType = tcpSkipSucReq
-		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Read in the response
-		resp := tcpBodyError{}
-		if err := out.dec.Decode(&resp); err != nil {
-			errChan <- err
-			return
-		}
-
-		// Return the connection
-		t.returnConn(out)
-		if resp.Err == nil {
-			respChan <- true
-		} else {
-			errChan <- resp.Err
-		}
-	}()
-
-	select {
-	case <-time.After(t.timeout):
-		return fmt.Errorf("Command timed out!")
-	case err := <-errChan:
-		return err
-	case <-respChan:
-		return nil
+	resp, ok := body.(*tcpBodyError)
+	if !ok {
+		return unexpectedResponse(tcpSkipSucReq, body)
 	}
+	return resp.Err
 }
 
 // Register for an RPC callbacks
@@ -584,7 +889,7 @@ func (t *TCPTransport) Shutdown() {
 			out.sock.Close()
 		}
 	}
-	t.pool = nil
+	t.pool = make(map[string][]*tcpOutConn)
 	t.poolLock.Unlock()
 }
 
@@ -605,7 +910,7 @@ func (t *TCPTransport) reapOnce() {
 	for host, conns := range t.pool {
 		max := len(conns)
 		for i := 0; i < max; i++ {
-			if time.Since(conns[i].used) > t.maxIdle {
+			if conns[i].inFlight() == 0 && time.Since(conns[i].used) > t.maxIdle {
 				conns[i].sock.Close()
 				conns[i], conns[max-1] = conns[max-1], nil
 				max--
@@ -630,21 +935,26 @@ func (t *TCPTransport) listen() {
 			}
 		}
 
-		// Setup the conn
+		// Setup the conn, the TLS handshake happens on the first read
 		t.setupConn(conn)
+		var c net.Conn = conn
+		if t.tlsServer != nil {
+			c = tls.Server(conn, t.tlsServer)
+		}
 
 		// Register the inbound conn
 		t.lock.Lock()
-		t.inbound[conn] = struct{}{}
+		t.inbound[c] = struct{}{}
 		t.lock.Unlock()
 
 		// Start handler
-		go t.handleConn(conn)
+		go t.handleConn(c)
 	}
 }
 
-// Handles inbound TCP connections
-func (t *TCPTransport) handleConn(conn *net.TCPConn) {
+// Handles inbound TCP connections. Requests are read in order and each one
+// is handled in its own Goroutine, responses are written as they complete.
+func (t *TCPTransport) handleConn(conn net.Conn) {
 	// Defer the cleanup
 	defer func() {
 		t.lock.Lock()
@@ -653,167 +963,273 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		conn.Close()
 	}()
 
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	header := tcpHeader{}
-	var sendResp interface{}
+	reader := bufio.NewReader(conn)
+
+	// Negotiate the protocol version
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	min, max, err := readHello(reader)
+	if err != nil {
+		log.Printf("[ERR] Failed to read TCP handshake! Got %s", err)
+		return
+	}
+	version := negotiateVersion(min, max)
+	if err := writeWelcome(conn, version); err != nil || version == 0 {
+		log.Printf("[ERR] Failed TCP handshake! Peer speaks versions %d to %d", min, max)
+		return
+	}
+	var nonce []byte
+	if version >= tcpNonceVersion {
+		if nonce, err = exchangeNonces(conn, reader, true); err != nil {
+			log.Printf("[ERR] Failed to exchange TCP nonces! Got %s", err)
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Peers that cannot seal their messages cannot prove their ring
+	ident := t.ringIdentity()
+	remote := conn.RemoteAddr().String()
+	cert := peerCertificate(conn)
+	if ident != nil && version < ident.minVersion() {
+		t.reject(remote, "", fmt.Errorf("%w Peer speaks version %d, the ring identity needs %d",
+			ErrForeignRing, version, ident.minVersion()))
+		return
+	}
+
+	var encLock sync.Mutex
 	for {
-		// Get the header
-		if err := dec.Decode(&header); err != nil {
+		// Get the frame
+		msgType, reqID, payload, _, err := readFrame(reader)
+		if err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 && err.Error() != "EOF" {
-				log.Printf("[ERR] Failed to decode TCP header! Got %s", err)
+				log.Printf("[ERR] Failed to read TCP frame! Got %s", err)
 			}
 			return
 		}
 
-		// Read in the body and process request
-		switch header.ReqType {
-		case tcpPing:
-			body := tcpBodyVnode{}
-			if err := dec.Decode(&body); err != nil {
+		// Decode the body
+		reqType := int(msgType)
+		body := newTcpRequest(reqType)
+		if body == nil {
+			log.Printf("[ERR] Unknown request type! Got %d", reqType)
+			return
+		}
+		var rejected error
+		if version >= tcpIdentityVersion {
+			var ringID string
+			payload, ringID, err = ident.open(nonce, msgType, reqID, payload)
+			if errors.Is(err, ErrForeignRing) {
+				t.reject(remote, ringID, err)
+				rejected = err
+			} else if err != nil {
+				log.Printf("[ERR] Failed to open TCP envelope! Got %s", err)
+				return
+			}
+		}
+		if rejected == nil {
+			if err := decodeMessage(payload, body, version); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
-
-			// Generate a response
-			_, ok := t.get(body.Vn)
-			if ok {
-				sendResp = tcpBodyBoolError{B: ok, Err: nil}
-			} else {
-				sendResp = tcpBodyBoolError{B: ok, Err: fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Vn.Host, body.Vn.String())}
+			rejected = validateRequest(reqType, body)
+			if rejected == nil {
+				rejected = t.verifySender(cert, reqType, body)
 			}
+		}
 
-		case tcpListReq:
-			body := tcpBodyString{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+		// Process the request, rejected requests are answered with the error
+		go func(reqType int, reqID uint64, body wireMessage) {
+			sendResp, ok := errorResponse(reqType, rejected), true
+			if rejected == nil {
+				sendResp, ok = t.handleRequest(reqType, body)
+			}
+			if !ok {
+				conn.Close()
 				return
 			}
 
-			// Generate all the local clients
-			res := make([]*Vnode, 0, len(t.local))
-
-			// Build list
-			t.lock.RLock()
-			for _, v := range t.local {
-				res = append(res, v.vnode)
+			// Send the response
+			payload := encodeMessage(sendResp, version)
+			if version >= tcpIdentityVersion {
+				payload = ident.seal(nonce, uint8(reqType)|tcpRespFlag, reqID, payload)
+			}
+			encLock.Lock()
+			defer encLock.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(t.timeout))
+			if _, err := writeFrame(conn, uint8(reqType)|tcpRespFlag, reqID, payload); err != nil {
+				log.Printf("[ERR] Failed to send TCP response! Got %s", err)
+				conn.Close()
 			}
-			t.lock.RUnlock()
+		}(reqType, reqID, body)
+	}
+}
 
-			// Make response
-			sendResp = tcpBodyVnodeListError{Vnodes: trimSlice(res)}
+// Generates the response to an inbound request. Returns false if the
+// connection should be dropped instead.
+func (t *TCPTransport) handleRequest(reqType int, reqBody wireMessage) (wireMessage, bool) {
+	switch reqType {
+	case tcpPing:
+		body := reqBody.(*tcpBodyVnode)
+
+		// Generate a response
+		_, ok := t.get(body.Vn)
+		if ok {
+			return &tcpBodyBoolError{B: ok, Err: nil}, true
+		}
+		return &tcpBodyBoolError{B: ok, Err: fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+			body.Vn.Host, body.Vn.String())}, true
 
-		case tcpGetPredReq:
-			body := tcpBodyVnode{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
-				return
-			}
+	case tcpListReq:
+		// Generate all the local clients
+		t.lock.RLock()
+		res := make([]*Vnode, 0, len(t.local))
 
-			// Generate a response
-			obj, ok := t.get(body.Vn)
-			resp := tcpBodyVnodeError{}
-			sendResp = &resp
-			if ok {
-				node, err := obj.GetPredecessor()
-				resp.Vnode = node
-				resp.Err = err
-			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Vn.Host, body.Vn.String())
-			}
+		// Build list
+		for _, v := range t.local {
+			res = append(res, v.vnode)
+		}
+		t.lock.RUnlock()
 
-		case tcpNotifyReq:
-			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
-				return
-			}
-			if body.Target == nil {
-				return
-			}
+		// Make response
+		return &tcpBodyVnodeListError{Vnodes: trimSlice(res)}, true
 
-			// Generate a response
-			obj, ok := t.get(body.Target)
-			resp := tcpBodyVnodeListError{}
-			sendResp = &resp
-			if ok {
-				nodes, err := obj.Notify(body.Vn)
-				resp.Vnodes = trimSlice(nodes)
-				resp.Err = err
-			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
-			}
+	case tcpGetPredReq:
+		body := reqBody.(*tcpBodyVnode)
 
-		case tcpFindSucReq:
-			body := tcpBodyFindSuc{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
-				return
-			}
+		// Generate a response
+		obj, ok := t.get(body.Vn)
+		resp := tcpBodyVnodeError{}
+		if ok {
+			node, err := obj.GetPredecessor()
+			resp.Vnode = node
+			resp.Err = err
+		} else {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Vn.Host, body.Vn.String())
+		}
+		return &resp, true
 
-			// Generate a response
-			obj, ok := t.get(body.Target)
-			resp := tcpBodyVnodeListError{}
-			sendResp = &resp
-			if ok {
-				nodes, _, _, err := obj.FindSuccessors(body.Num, body.Key)
-				resp.Vnodes = trimSlice(nodes)
-				resp.Err = err
-			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
-			}
+	case tcpNotifyReq:
+		body := reqBody.(*tcpBodyTwoVnode)
 
-		case tcpClearPredReq:
-			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
-				return
-			}
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyVnodeListError{}
+		if ok {
+			nodes, err := obj.Notify(body.Vn)
+			resp.Vnodes = trimSlice(nodes)
+			resp.Err = err
+		} else {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		}
+		return &resp, true
 
-			// Generate a response
-			obj, ok := t.get(body.Target)
-			resp := tcpBodyError{}
-			sendResp = &resp
-			if ok {
-				resp.Err = obj.ClearPredecessor(body.Vn)
-			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
-			}
+	case tcpFindSucReq:
+		body := reqBody.(*tcpBodyFindSuc)
 
-		case tcpSkipSucReq:
-			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
-				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
-				return
-			}
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyVnodeListError{}
+		if ok {
+			nodes, _, _, err := obj.FindSuccessors(body.Num, body.Key)
+			resp.Vnodes = trimSlice(nodes)
+			resp.Err = err
+		} else {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		}
+		return &resp, true
 
-			// Generate a response
-			obj, ok := t.get(body.Target)
-			resp := tcpBodyError{}
-			sendResp = &resp
-			if ok {
-				resp.Err = obj.SkipSuccessor(body.Vn)
-			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
-			}
+	case tcpClearPredReq:
+		body := reqBody.(*tcpBodyTwoVnode)
 
-		default:
-			log.Printf("[ERR] Unknown request type! Got %d", header.ReqType)
-			return
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyError{}
+		if ok {
+			resp.Err = obj.ClearPredecessor(body.Vn)
+		} else {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
 		}
+		return &resp, true
 
-		// Send the response
-		if err := enc.Encode(sendResp); err != nil {
-			log.Printf("[ERR] Failed to send TCP body! Got %s", err)
-			return
+	case tcpSkipSucReq:
+		body := reqBody.(*tcpBodyTwoVnode)
+
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyError{}
+		if ok {
+			resp.Err = obj.SkipSuccessor(body.Vn)
+		} else {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		}
+		return &resp, true
+
+	case tcpPingViaReq:
+		body := reqBody.(*tcpBodyTwoVnode)
+
+		// Only vnodes of this host take part in probing, and only their
+		// neighbours are pinged
+		t.lock.RLock()
+		known := knownHost(t.local, body.Vn.Host)
+		t.lock.RUnlock()
+		resp := tcpBodyBoolError{}
+		if _, ok := t.get(body.Target); !ok {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		} else if _, ok := t.get(body.Vn); ok {
+			resp.B = true
+		} else if !known {
+			resp.Err = fmt.Errorf("%w Host %s is not a neighbour", ErrInvalidRequest, body.Vn.Host)
+		} else {
+			resp.B, resp.Err = t.Ping(body.Vn)
+		}
+		return &resp, true
+
+	case tcpClosestPrecReq:
+		body := reqBody.(*tcpBodyFindSuc)
+
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyTwoVnodeListError{}
+		if !ok {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		} else if local, ok := obj.(*localVnode); ok {
+			succs, next, err := local.ClosestPreceding(body.Num, body.Key)
+			resp.Vnodes = trimSlice(succs)
+			resp.Next = next
+			resp.Err = err
+		} else {
+			resp.Err = fmt.Errorf("Vnode %s does not support iterative lookups", body.Target.String())
+		}
+		return &resp, true
+
+	case tcpFindSucBatchReq:
+		body := reqBody.(*tcpBodyFindSucBatch)
+
+		// Generate a response
+		obj, ok := t.get(body.Target)
+		resp := tcpBodyVnodeListsError{}
+		if !ok {
+			resp.Err = fmt.Errorf("%w Target %s:%s", ErrVnodeNotFound,
+				body.Target.Host, body.Target.String())
+		} else if local, ok := obj.(*localVnode); ok {
+			lists, err := local.FindSuccessorsBatch(body.Num, body.Keys)
+			for _, succs := range lists {
+				resp.Lists = append(resp.Lists, trimSlice(succs))
+			}
+			resp.Err = err
+		} else {
+			resp.Err = fmt.Errorf("Vnode %s does not support batch lookups", body.Target.String())
 		}
+		return &resp, true
 	}
+	return nil, false
 }
 
 // Trims the slice to remove nil elements
@@ -824,7 +1240,7 @@ func trimSlice(vn []*Vnode) []*Vnode {
 
 	// Find a non-nil index
 	idx := len(vn) - 1
-	for vn[idx] == nil {
+	for idx >= 0 && vn[idx] == nil {
 		idx--
 	}
 	return vn[:idx+1]
@@ -0,0 +1,143 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// How a lookup that failed, for example because every closest preceding node
+// was unreachable, is retried. Retries alternate between walking successor
+// lists, which does not depend on the fingers, and a regular lookup, and move
+// on to the next local vnode preceding the key every two attempts.
+type LookupRetryPolicy struct {
+	Retries  int           // Attempts after the first one, 0 to fail at once
+	Backoff  time.Duration // Wait before the first retry, doubled for each further one
+	Jitter   float64       // Share of each wait randomly added or taken off, between 0 and 1
+	Deadline time.Duration // Time after which no further attempt is started, 0 for no limit
+}
+
+// Returns the wait before a retry with the jitter applied
+func (p LookupRetryPolicy) wait(backoff time.Duration) time.Duration {
+	jitter := p.Jitter
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return backoff + time.Duration((2*rand.Float64()-1)*jitter*float64(backoff))
+}
+
+// Finds the next N successors of a key from the nearest local vnode, retrying
+// as the retry policy of the ring allows
+func (r *Ring) retryLookup(mode LookupMode, n int, key []byte) ([]*Vnode, error) {
+	policy := r.config.LookupRetry
+	start := time.Now()
+	origins := r.lookupOrigins(key)
+	succs, _, _, err := origins[0].lookup(mode, n, key)
+
+	backoff := policy.Backoff
+	attempt := 1
+	for ; err != nil && attempt <= policy.Retries; attempt++ {
+		log.Printf("[ERR] Lookup attempt %d failed. Got %s", attempt, err)
+		wait := policy.wait(backoff)
+		if policy.Deadline > 0 && time.Since(start)+wait >= policy.Deadline {
+			break
+		}
+		time.Sleep(wait)
+		backoff *= 2
+
+		origin := origins[(attempt/2)%len(origins)]
+		if attempt%2 == 1 {
+			succs, err = r.walkSuccessors(origin, n, key)
+		} else {
+			succs, _, _, err = origin.lookup(mode, n, key)
+		}
+	}
+	if err != nil && attempt > 1 {
+		return nil, fmt.Errorf("Lookup failed after %d attempts: %w", attempt, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return succs, nil
+}
+
+// Returns the local vnodes in the order they precede a key, starting with the
+// nearest one. Vnodes that are shut down are skipped after the first.
+func (r *Ring) lookupOrigins(key []byte) []*localVnode {
+	vnodes := r.localVnodes()
+	nearest := nearestIn(vnodes, key)
+	origins := []*localVnode{nearest}
+	idx := 0
+	for i, vn := range vnodes {
+		if vn == nearest {
+			idx = i
+		}
+	}
+	for i := 1; i < len(vnodes); i++ {
+		vn := vnodes[(idx-i+len(vnodes))%len(vnodes)]
+		if vn != nil && !vn.Shutdown {
+			origins = append(origins, vn)
+		}
+	}
+	return origins
+}
+
+/*
+	Finds the next N successors of a key by walking successor lists from a
+	local vnode, without using any fingers. Each step asks the furthest vnode
+	of the current list that answers for its own list, so the walk needs about
+	one step per NumSuccessors vnodes, but only relies on the successor lists
+	that stabilization keeps correct. The walk fails when it wraps around the
+	ring or no vnode of a list answers.
+*/
+func (r *Ring) walkSuccessors(vn *localVnode, n int, key []byte) ([]*Vnode, error) {
+	prev := &vn.Vnode
+	succs := append([]*Vnode(nil), vn.successors[:vn.knownSuccessors()]...)
+	visited := map[string]bool{vn.String(): true}
+	for {
+		// Check if the key falls in the current list
+		hop := prev
+		for i, s := range succs {
+			if s == nil {
+				break
+			}
+			if bytes.Equal(key, s.Id) || global.BetweenRightIncl(hop.Id, s.Id, key) {
+				// The vnode before the owner knows its successors
+				if res, _, _, err := r.transport.FindSuccessors(hop, n, key); err == nil && len(res) > 0 && res[0] != nil {
+					return res, nil
+				}
+				res := succs[i:]
+				if len(res) > n {
+					res = res[:n]
+				}
+				return res, nil
+			}
+			hop = s
+		}
+
+		// Continue from the furthest vnode that answers
+		var next []*Vnode
+		for i := len(succs) - 1; i >= 0 && next == nil; i-- {
+			s := succs[i]
+			if s == nil || visited[s.String()] {
+				continue
+			}
+			res, _, _, err := r.transport.FindSuccessors(s, r.config.NumSuccessors, s.Id)
+			if err != nil || len(res) == 0 || res[0] == nil {
+				log.Printf("[ERR] Failed to get the successors of %s. Got %v", s.String(), err)
+				continue
+			}
+			visited[s.String()] = true
+			prev, next = s, res
+		}
+		if next == nil {
+			return nil, fmt.Errorf("%s: %w walking the successor lists", vn.Vnode.String(), ErrLookupExhausted)
+		}
+		succs = next
+	}
+}
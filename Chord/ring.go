@@ -10,20 +10,35 @@ import (
 	"log"
 	"math/rand"
 	"sort"
+	"sync"
 	"time"
 	"github.com/ahrtr/logrus"
 )
 
 // Configuration for Chord nodes
 type Config struct {
-	Hostname      string           // Local host name
-	NumVnodes     int              // Number of vnodes per physical chord
-	HashFunc      func() hash.Hash // Hash function to use
-	StabilizeMin  time.Duration    // Minimum stabilization time
-	StabilizeMax  time.Duration    // Maximum stabilization time
-	NumSuccessors int              // Number of successors to maintain
-	Delegate      Delegate         // Invoked to handle ring events
-	hashBits      int              // Bit size of the hash function
+	Hostname            string            // Local host name
+	NumVnodes           int               // Number of vnodes per physical chord of weight 1
+	HashFunc            func() hash.Hash  // Hash function to use
+	StabilizeMin        time.Duration     // Minimum stabilization time
+	StabilizeMax        time.Duration     // Maximum stabilization time
+	NumSuccessors       int               // Number of successors to maintain
+	Delegate            Delegate          // Invoked to handle ring events
+	RingID              string            // Identifies the ring, messages from other rings are rejected
+	RingSecret          []byte            // Shared secret messages are authenticated with, nil for none
+	VerifyIds           bool              // Reject remote vnodes whose ID is not the hash of their host and index
+	HeartbeatInterval   time.Duration     // Interval of UDP heartbeats to neighbours, 0 to only ping over the transport
+	HeartbeatTimeout    time.Duration     // Time to wait for the first heartbeat from a neighbour
+	SuspicionThreshold  float64           // Phi above which a neighbour is dead, 0 for the default of 8
+	IndirectProbes      int               // Vnodes asked to ping a neighbour before it is evicted, 0 to evict on a failed ping
+	LookupMode          LookupMode        // How lookups are routed, recursive by default
+	ProximityCandidates int               // Vnodes considered for each finger, the one with the lowest RTT is used, 0 or 1 for the exact successor
+	LocationCacheSize   int               // Key ranges whose owner is remembered from previous lookups, 0 to disable the cache
+	LocationCacheTTL    time.Duration     // Age after which a remembered owner is looked up again, 0 for StabilizeMax
+	VerifyLookups       bool              // Confirm the owner of each looked up key with its predecessor, correcting stale results
+	LookupRetry         LookupRetryPolicy // Retries of failed lookups from other vnodes and over successor lists
+	Weight              float64           // Capacity of the host, scales NumVnodes, 0 for a weight of 1
+	hashBits            int               // Bit size of the hash function
 }
 
 // Stores the state required for a Chord ring
@@ -34,17 +49,45 @@ type Ring struct {
 	delegateCh                chan func()
 	shutdown                  chan bool
 	connectedAppendagesFailed bool
+	lock                      sync.RWMutex   // Guards vnodes, Weight and shutdown
+	resizeLock                sync.Mutex     // Serializes adding and removing vnodes
+	detector                  *udpDetector   // UDP failure detector, nil if disabled
+	liveness                  *phiTracker    // Heartbeat history of pinged vnodes
+	cache                     *locationCache // Owners learned from lookups, nil if disabled
+	lookups                   lookupCounters // Outcomes of verified lookups
+	weight                    vnodeWeight    // Vnode count the host is moving towards
 }
 
 func (r *Ring) init(conf *Config, trans Transport) {
 	// Set our variables
 	r.config = conf
-	r.vnodes = make([]*localVnode, conf.NumVnodes)
+
+	// Scale the vnode count by the capacity of the host, the config keeps the
+	// count of weight 1 so it can be reused
+	r.weight.perWeight = conf.NumVnodes
+	r.weight.target = weightedVnodes(conf.NumVnodes, conf.Weight)
+	r.vnodes = make([]*localVnode, r.weight.target)
 	r.transport = InitLocalTransport(trans)
 	r.delegateCh = make(chan func(), 32)
+	r.liveness = newPhiTracker(conf.StabilizeMax, conf.SuspicionThreshold)
+	cacheTTL := conf.LocationCacheTTL
+	if cacheTTL <= 0 {
+		cacheTTL = conf.StabilizeMax
+	}
+	r.cache = newLocationCache(conf.LocationCacheSize, cacheTTL)
+
+	// Reject messages from other rings, if the transport can tell
+	if checker, ok := trans.(RingIdentityChecker); ok && (conf.RingID != "" || conf.RingSecret != nil) {
+		checker.SetRingIdentity(conf.RingID, conf.RingSecret, r.foreignRing)
+	}
+
+	// Check remote vnodes against peer certificates, if the transport can tell
+	if verifier, ok := trans.(VnodeHostVerifier); ok && conf.VerifyIds {
+		verifier.SetVerifyVnodeHosts(true)
+	}
 
 	// Initializes the vnodes
-	for i := 0; i < conf.NumVnodes; i++ {
+	for i := 0; i < len(r.vnodes); i++ {
 		vn := &localVnode{}
 		r.vnodes[i] = vn
 		vn.ring = r
@@ -73,13 +116,26 @@ func (r *Ring) Swap(i, j int) {
 
 // Returns the nearest local vnode to the key
 func (r *Ring) nearestVnode(key []byte) *localVnode {
-	for i := len(r.vnodes) - 1; i >= 0; i-- {
-		if bytes.Compare(r.vnodes[i].Id, key) == -1 {
-			return r.vnodes[i]
+	return nearestIn(r.localVnodes(), key)
+}
+
+// Returns the local vnodes. The slice is replaced rather than changed when
+// vnodes are added or removed, so it can be used without holding the lock.
+func (r *Ring) localVnodes() []*localVnode {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.vnodes
+}
+
+// Returns the vnode of a sorted list that is closest preceding the key
+func nearestIn(vnodes []*localVnode, key []byte) *localVnode {
+	for i := len(vnodes) - 1; i >= 0; i-- {
+		if bytes.Compare(vnodes[i].Id, key) == -1 {
+			return vnodes[i]
 		}
 	}
 	// Return the last vnode
-	return r.vnodes[len(r.vnodes)-1]
+	return vnodes[len(vnodes)-1]
 }
 
 // Schedules each vnode in the ring
@@ -94,8 +150,11 @@ func (r *Ring) schedule() {
 
 // Wait for all the vnodes to shutdown
 func (r *Ring) stopVnodes() {
-	r.shutdown = make(chan bool, r.config.NumVnodes)
-	for i := 0; i < r.config.NumVnodes; i++ {
+	r.lock.Lock()
+	num := len(r.vnodes)
+	r.shutdown = make(chan bool, num)
+	r.lock.Unlock()
+	for i := 0; i < num; i++ {
 		<-r.shutdown
 	}
 }
@@ -120,6 +179,95 @@ func (r *Ring) setLocalSuccessors() {
 	}
 }
 
+// Starts the UDP failure detector on the host address, if heartbeats are enabled
+func (r *Ring) startDetector() error {
+	conf := r.config
+	if conf.HeartbeatInterval <= 0 {
+		return nil
+	}
+	timeout := conf.HeartbeatTimeout
+	if timeout <= 0 {
+		timeout = 3 * conf.HeartbeatInterval
+	}
+	threshold := conf.SuspicionThreshold
+	if threshold <= 0 {
+		threshold = defaultSuspicionThreshold
+	}
+	var ident *ringIdentity
+	if conf.RingID != "" || conf.RingSecret != nil {
+		ident = &ringIdentity{id: conf.RingID, secret: conf.RingSecret}
+	}
+	d, err := initUDPDetector(conf.Hostname, conf.HeartbeatInterval, timeout,
+		2*conf.StabilizeMax+timeout, threshold, r.isLocal, ident)
+	if err != nil {
+		return fmt.Errorf("Failed to start UDP failure detector! Got %s", err)
+	}
+	r.detector = d
+	return nil
+}
+
+// Stops the UDP failure detector
+func (r *Ring) stopDetector() {
+	if r.detector != nil {
+		r.detector.stop()
+	}
+}
+
+// Returns whether a vnode is registered on this host
+func (r *Ring) isLocal(vn *Vnode) bool {
+	lt, ok := r.transport.(*LocalTransport)
+	if !ok {
+		return false
+	}
+	_, ok = lt.get(vn)
+	return ok
+}
+
+// Checks whether a vnode is alive, using the failure detector when it can
+// tell and pinging over the transport otherwise. Successful pings are
+// heartbeats, a failed ping only declares the vnode dead once its phi
+// crosses the suspicion threshold.
+func (r *Ring) isAlive(vn *Vnode) (bool, error) {
+	if r.detector != nil {
+		if alive, known := r.detector.status(vn); known {
+			return alive, nil
+		}
+	}
+	alive, err := r.transport.Ping(vn)
+	if alive {
+		r.liveness.heartbeat(vn)
+		return alive, err
+	}
+	if stillAlive, known := r.liveness.status(vn); known && stillAlive {
+		log.Printf("[WARN] Ping to %s failed, suspecting it until phi crosses the threshold", vn.String())
+		return true, nil
+	}
+	return alive, err
+}
+
+// Reports whether a vnode is known to be dead without contacting it, or
+// starting to watch it
+func (r *Ring) knownDead(vn *Vnode) bool {
+	if r.detector != nil {
+		if alive, known := r.detector.peek(vn); known && !alive {
+			return true
+		}
+	}
+	alive, known := r.liveness.status(vn)
+	return known && !alive
+}
+
+// Reports a message from a foreign ring to the delegate, if it listens
+func (r *Ring) foreignRing(remote, ringID string) {
+	d, ok := r.config.Delegate.(ForeignRingDelegate)
+	if !ok {
+		return
+	}
+	r.invokeDelegate(func() {
+		d.ForeignRing(remote, ringID)
+	})
+}
+
 // Invokes a function on the delegate and returns completion channel
 func (r *Ring) invokeDelegate(f func()) chan struct{} {
 	if r.config.Delegate == nil {
@@ -167,9 +315,23 @@ func DefaultConfig(hostname string) *Config {
 		sha1.New, // SHA1
 		time.Duration(5 * time.Second),
 		time.Duration(10 * time.Second),
-		8,   // 8 successors
-		nil, // No delegate
-		160, // 160bit hash function
+		8,                   // 8 successors
+		nil,                 // No delegate
+		"",                  // No ring identity
+		nil,                 // No ring secret
+		false,               // Trust remote vnode IDs
+		0,                   // No UDP heartbeats
+		0,                   // Default heartbeat timeout
+		0,                   // Default suspicion threshold
+		0,                   // No indirect probes
+		RecursiveLookup,     // Recursive lookups
+		0,                   // Exact successor fingers
+		0,                   // No location cache
+		0,                   // Cached owners expire after StabilizeMax
+		false,               // Trust lookup results
+		LookupRetryPolicy{}, // No lookup retries
+		0,                   // Weight 1
+		160,                 // 160bit hash function
 	}
 }
 
@@ -181,6 +343,9 @@ func Create(conf *Config, trans Transport) (*Ring, error) {
 	// Create and initialize a ring
 	ring := &Ring{}
 	ring.init(conf, trans)
+	if err := ring.startDetector(); err != nil {
+		return nil, err
+	}
 	ring.setLocalSuccessors()
 	ring.schedule()
 	return ring, nil
@@ -191,19 +356,24 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	// Initialize the hash bits
 	conf.hashBits = conf.HashFunc().Size() * 8
 
+	// Create a ring, this sets the ring identity before anything is sent
+	ring := &Ring{}
+	ring.init(conf, trans)
+	if err := ring.startDetector(); err != nil {
+		return nil, err
+	}
+
 	// Request a list of Vnodes from the remote host
 	hosts, err := trans.ListVnodes(existing)
 	if err != nil {
+		ring.stopDetector()
 		return nil, err
 	}
 	if hosts == nil || len(hosts) == 0 {
+		ring.stopDetector()
 		return nil, fmt.Errorf("Remote host has no vnodes!")
 	}
 
-	// Create a ring
-	ring := &Ring{}
-	ring.init(conf, trans)
-
 	// Acquire a live successor for each Vnode
 	for _, vn := range ring.vnodes {
 		// Get the nearest remote vnode
@@ -212,9 +382,12 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 		// Query for a list of successors to this Vnode
 		succs, _, _, err := trans.FindSuccessors(nearest, conf.NumSuccessors, vn.Id)
 		if err != nil {
+			ring.stopDetector()
 			return nil, fmt.Errorf("Failed to find successor for vnodes! Got %s", err)
 		}
+		succs = ring.filterVnodes(succs)
 		if succs == nil || len(succs) == 0 {
+			ring.stopDetector()
 			return nil, fmt.Errorf("Failed to find successor for vnodes! Got no vnodes!")
 		}
 
@@ -239,52 +412,157 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 // Leaves a given Chord ring and shuts down the local vnodes
 func (r *Ring) Leave() error {
 	// Shutdown the vnodes first to avoid further stabilization runs
+	r.stopRebalance()
 	r.stopVnodes()
 
 	// Instruct each vnode to leave
 	var err error
-	for _, vn := range r.vnodes {
+	for _, vn := range r.localVnodes() {
 		err = global.MergeErrors(err, vn.leave())
 	}
 
 	// Wait for the delegate callbacks to complete
 	r.stopDelegate()
+	r.stopDetector()
 	return err
 }
 
 // Shutdown shuts down the local processes in a given Chord ring
 // Blocks until all the vnodes terminate.
 func (r *Ring) Shutdown() {
+	r.stopRebalance()
 	r.stopVnodes()
 	r.stopDelegate()
+	r.stopDetector()
 }
 
-// Does a key lookup for up to N successors of a key
+// Does a key lookup for up to N successors of a key, routed with the
+// configured lookup mode. N may exceed NumSuccessors, the successor lists
+// past the owner are then walked to find the rest.
 func (r *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
-	// Ensure that n is sane
-	if n > r.config.NumSuccessors {
-		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
-	}
+	return r.LookupWithMode(r.config.LookupMode, n, key)
+}
 
-	// Hash the key
-	h := r.config.HashFunc()
-	h.Write(key)
-	key_hash := h.Sum(nil)
+// Does a key lookup for up to N successors of a key, routed with the given mode
+func (r *Ring) LookupWithMode(mode LookupMode, n int, key []byte) ([]*Vnode, error) {
+	return r.lookupID(mode, n, r.hashKey(key))
+}
 
-	// Find the nearest local vnode
-	nearest := r.nearestVnode(key_hash)
+// Does a lookup for up to N successors of an ID that is already hashed
+func (r *Ring) lookupID(mode LookupMode, n int, key_hash []byte) ([]*Vnode, error) {
+	k := r.lookupSize(n)
 
-	// Use the nearest chord for the lookup
-	successors, _, _, err := nearest.FindSuccessors(n, key_hash)
+	// Answer hot keys from the location cache
+	if successors, ok := r.cache.get(n, key_hash, r.knownDead); ok {
+		return r.finishLookup(n, k, key_hash, successors, true), nil
+	}
+
+	// Use the nearest chord for the lookup, retrying on failure
+	successors, err := r.retryLookup(mode, k, key_hash)
 	if err != nil {
 		return nil, err
 	}
+	return r.finishLookup(n, k, key_hash, successors, false), nil
+}
+
+// Returns the number of successors a lookup for N successors asks for. A
+// single successor list holds at most NumSuccessors vnodes, and verified
+// lookups fetch the whole list, to fall back on if the owner failed.
+func (r *Ring) lookupSize(n int) int {
+	if n > r.config.NumSuccessors || r.config.VerifyLookups {
+		return r.config.NumSuccessors
+	}
+	return n
+}
 
+// Confirms the owner of a lookup result, extends it to N successors and
+// remembers it in the location cache. Cached results are only learned again
+// if they were corrected.
+func (r *Ring) finishLookup(n, k int, key_hash []byte, successors []*Vnode, cached bool) []*Vnode {
 	// Trim the nil successors
-	for successors[len(successors)-1] == nil {
+	for len(successors) > 0 && successors[len(successors)-1] == nil {
 		successors = successors[:len(successors)-1]
 	}
-	return successors, nil
+
+	// Confirm the owner, the ring may have changed under the lookup
+	successors, corrected := r.checkLookup(k, key_hash, successors)
+	if cached && !corrected {
+		return successors
+	}
+	if n > k {
+		successors = r.extendSuccessors(successors, n)
+	}
+	r.cache.learn(key_hash, nil, successors, r.config.hashBits)
+	if len(successors) > n {
+		successors = successors[:n]
+	}
+	return successors
+}
+
+// Extends a list of successors to n vnodes by walking the successor lists
+// that follow it. Returns fewer if the ring has fewer vnodes.
+func (r *Ring) extendSuccessors(succs []*Vnode, n int) []*Vnode {
+	seen := make(map[string]bool, n)
+	for _, s := range succs {
+		seen[s.String()] = true
+	}
+	for len(succs) > 0 && len(succs) < n {
+		added := 0
+		for _, s := range r.nextSuccessors(succs) {
+			// Stop once the walk wraps around the ring
+			if s == nil || seen[s.String()] || len(succs) == n {
+				break
+			}
+			seen[s.String()] = true
+			succs = append(succs, s)
+			added++
+		}
+		if added == 0 {
+			break
+		}
+	}
+	return succs
+}
+
+// Returns the vnodes following the last one of a list of successors. The last
+// vnode is asked for its successor list, or an earlier one if it fails.
+func (r *Ring) nextSuccessors(succs []*Vnode) []*Vnode {
+	last := succs[len(succs)-1]
+	for i := len(succs) - 1; i >= 0; i-- {
+		// A vnode asked about its own ID returns its successor list
+		res, _, _, err := r.transport.FindSuccessors(succs[i], r.config.NumSuccessors, succs[i].Id)
+		if err != nil {
+			log.Printf("[ERR] Failed to get the successors of %s. Got %s", succs[i].String(), err)
+			continue
+		}
+		if i == len(succs)-1 {
+			return res
+		}
+
+		// Skip the part of the list that is already known
+		for j, s := range res {
+			if s != nil && s.String() == last.String() {
+				return res[j+1:]
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Returns the per RPC counters of the transport, if it keeps any
+func (r *Ring) RPCStats() map[string]RPCStats {
+	if provider, ok := r.transport.(RPCStatsProvider); ok {
+		return provider.RPCStats()
+	}
+	return make(map[string]RPCStats)
+}
+
+// Hashes a key onto the ring using the configured hash function
+func (r *Ring) hashKey(key []byte) []byte {
+	h := r.config.HashFunc()
+	h.Write(key)
+	return h.Sum(nil)
 }
 
 // Generates a random stabilization time
@@ -307,7 +585,7 @@ func NearestVnodeToKey(vnodes []*Vnode, key []byte) *Vnode {
 }
 
 func (r *Ring) GetLocalNode(vnode *Vnode) (*localVnode, error) {
-	for _, node := range r.vnodes {
+	for _, node := range r.localVnodes() {
 		if bytes.Equal(node.Id, vnode.Id) {
 			return node, nil
 		}
@@ -316,7 +594,7 @@ func (r *Ring) GetLocalNode(vnode *Vnode) (*localVnode, error) {
 }
 
 func (r *Ring) PrintData() {
-	for _, node := range r.vnodes {
+	for _, node := range r.localVnodes() {
 		fmt.Println(node.DataStore)
 	}
 }
@@ -337,45 +615,11 @@ func (r *Ring) checkCorrectness(num int, sleep time.Duration, done chan bool, ve
 			The function will make assertions about Correctness invariants and send the result to a log
 	*/
 	events := r.generateEvents(num)
-	id := len(r.vnodes)
+	id := len(r.localVnodes())
 	logrus.Infof("Testing on %d events", num)
 	for _, event := range events {
-		val := rand.Intn(len(r.vnodes))
-		if event == "join" {
-			vn := &localVnode{}
-			vn.ring = r
-			vn.init(id)
-			id++
-			fmt.Println("join", vn, r.vnodes[2])
-			logrus.Infoln("join", vn.Num, r.vnodes[2].Num)
-			if version == "new" {
-				_, err := vn.joinNew(r.vnodes[2])
-				if err != nil {
-					logrus.Errorln("could not join the ring, found no valid successor")
-					continue
-				}
-			} else {
-				_, err := vn.join(r.vnodes[2])
-				if err != nil {
-					logrus.Errorln("could not join the ring, found no valid successor")
-					continue
-				}
-			}
-			r.vnodes = append(r.vnodes, vn)
-			go r.scheduleNode(vn)
-			sort.Sort(r)
-		}
-		if event == "leave" {
-			fmt.Println("leave", r.vnodes[val])
-			logrus.Infoln("leave", r.vnodes[val].Num)
-			r.vnodes[val].leave()
-			r.vnodes = append(r.vnodes[:val], r.vnodes[val+1:]...)
-		}
-		if event == "fail" {
-			fmt.Println("fail", r.vnodes[val])
-			logrus.Infoln("fail", r.vnodes[val].Num)
-			r.vnodes[val].fail()
-			r.vnodes = append(r.vnodes[:val], r.vnodes[val+1:]...)
+		if err := r.applyEvent(event, &id, version); err != nil {
+			continue
 		}
 		time.Sleep(sleep)
 		logrus.Infoln(r.PrintNodes())
@@ -386,6 +630,58 @@ func (r *Ring) checkCorrectness(num int, sleep time.Duration, done chan bool, ve
 	done <- pass
 }
 
+/*
+	Applies a single join, leave or fail event to the ring. Joins create a vnode with
+	the next free id and join it using the given version of the protocol, leave and
+	fail are called on a random vnode. The ring lock is only held while the vnodes
+	are picked and updated, not during the RPCs of the join or leave.
+*/
+func (r *Ring) applyEvent(event string, id *int, version string) error {
+	if event == "join" {
+		r.lock.Lock()
+		vn := &localVnode{}
+		vn.ring = r
+		vn.init(*id)
+		*id++
+		existing := r.vnodes[2]
+		r.lock.Unlock()
+
+		fmt.Println("join", vn, existing)
+		logrus.Infoln("join", vn.Num, existing.Num)
+		var err error
+		if version == "new" {
+			_, err = vn.joinNew(existing)
+		} else {
+			_, err = vn.join(existing)
+		}
+		if err != nil {
+			logrus.Errorln("could not join the ring, found no valid successor")
+			return err
+		}
+
+		r.lock.Lock()
+		r.vnodes = withVnode(r.vnodes, vn)
+		r.lock.Unlock()
+		go r.scheduleNode(vn)
+	}
+	if event == "leave" || event == "fail" {
+		r.lock.Lock()
+		val := rand.Intn(len(r.vnodes))
+		vn := r.vnodes[val]
+		r.vnodes = withoutVnode(r.vnodes, val)
+		r.lock.Unlock()
+
+		fmt.Println(event, vn)
+		logrus.Infoln(event, vn.Num)
+		if event == "leave" {
+			vn.leave()
+		} else {
+			vn.fail()
+		}
+	}
+	return nil
+}
+
 func (r *Ring) scheduleNode(vn *localVnode) {
 	fail := make(chan bool)
 	go vn.schedule(fail)
@@ -425,7 +721,9 @@ func (r *Ring) PrintNodes() []Nodes {
 	vnodeMap := make(map[int]bool)
 	vnodeSuccessorsMap := make(map[int][]int)
 	vnodePredecessorMap := make(map[int]int)
-	for _, vnode := range r.vnodes {
+	// Churn events change the vnodes meanwhile
+	vnodes := r.localVnodes()
+	for _, vnode := range vnodes {
 		vnodeMap[vnode.Num] = true
 		if vnode.predecessor != nil {
 			vnodePredecessorMap[vnode.Num] = vnode.predecessor.Num
@@ -433,7 +731,7 @@ func (r *Ring) PrintNodes() []Nodes {
 			vnodePredecessorMap[vnode.Num] = -1
 		}
 	}
-	for _, vnode := range r.vnodes {
+	for _, vnode := range vnodes {
 		vnodeSuccessorsMap[vnode.Num] = []int{}
 		var successors []int
 		for _, successor := range vnode.successors {
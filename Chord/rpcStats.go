@@ -0,0 +1,99 @@
+package chord
+
+import (
+	"sync"
+)
+
+// Names of the RPC types that are counted
+const (
+	rpcPing                = "Ping"
+	rpcListVnodes          = "ListVnodes"
+	rpcGetPredecessor      = "GetPredecessor"
+	rpcNotify              = "Notify"
+	rpcFindSuccessors      = "FindSuccessors"
+	rpcClearPredecessor    = "ClearPredecessor"
+	rpcSkipSuccessor       = "SkipSuccessor"
+	rpcPingVia             = "PingVia"
+	rpcClosestPreceding    = "ClosestPreceding"
+	rpcFindSuccessorsBatch = "FindSuccessorsBatch"
+)
+
+// The RPC types in the order they are reported
+var rpcTypes = []string{rpcPing, rpcListVnodes, rpcGetPredecessor, rpcNotify,
+	rpcFindSuccessors, rpcClearPredecessor, rpcSkipSuccessor, rpcPingVia, rpcClosestPreceding, rpcFindSuccessorsBatch}
+
+// Counters for a single RPC type
+type RPCStats struct {
+	Calls         uint64 // Number of requests sent
+	RequestBytes  uint64 // Bytes sent in requests
+	ResponseBytes uint64 // Bytes received in responses
+}
+
+// Implemented by transports that keep per RPC counters
+type RPCStatsProvider interface {
+	// Returns a copy of the counters, keyed by RPC type
+	RPCStats() map[string]RPCStats
+}
+
+// Thread safe set of per RPC counters
+type rpcCounters struct {
+	lock  sync.Mutex
+	stats map[string]*RPCStats
+}
+
+// Records a single RPC with its request and response sizes
+func (c *rpcCounters) record(rpc string, reqBytes, respBytes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*RPCStats)
+	}
+	s, ok := c.stats[rpc]
+	if !ok {
+		s = &RPCStats{}
+		c.stats[rpc] = s
+	}
+	s.Calls++
+	s.RequestBytes += uint64(reqBytes)
+	s.ResponseBytes += uint64(respBytes)
+}
+
+// Returns a copy of the counters
+func (c *rpcCounters) snapshot() map[string]RPCStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := make(map[string]RPCStats, len(c.stats))
+	for rpc, s := range c.stats {
+		res[rpc] = *s
+	}
+	return res
+}
+
+// Adds the counters of b to a
+func mergeRPCStats(a, b map[string]RPCStats) map[string]RPCStats {
+	for rpc, s := range b {
+		sum := a[rpc]
+		sum.Calls += s.Calls
+		sum.RequestBytes += s.RequestBytes
+		sum.ResponseBytes += s.ResponseBytes
+		a[rpc] = sum
+	}
+	return a
+}
+
+// Estimates the encoded size of a vnode, used when nothing goes over the wire
+func vnodeSize(vn *Vnode) int {
+	if vn == nil {
+		return 1
+	}
+	return 8 + len(vn.Id) + len(vn.Host)
+}
+
+// Estimates the encoded size of a list of vnodes
+func vnodesSize(vns []*Vnode) int {
+	size := 8
+	for _, vn := range vns {
+		size += vnodeSize(vn)
+	}
+	return size
+}
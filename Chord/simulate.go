@@ -3,6 +3,7 @@ package chord
 import (
 	"fmt"
 	"github.com/ahrtr/logrus"
+	"math/rand"
 	"time"
 	"sort"
 )
@@ -90,6 +91,7 @@ func (r *Ring) simulateScenario2() {
 		}
 	}
 	r.vnodes = append(r.vnodes[:val], r.vnodes[val+1:]...)
+	r.simulateLookups(100)
 
 	//Give enough time for stabilization and log the nodes
 	time.Sleep(20 * time.Second)
@@ -134,6 +136,7 @@ func (r *Ring) simulateScenario3() {
 		}
 	}
 	r.vnodes = append(r.vnodes[:val], r.vnodes[val+1:]...)
+	r.simulateLookups(100)
 
 	//Give enough time for stabilization and log the nodes
 	time.Sleep(20 * time.Second)
@@ -167,6 +170,7 @@ func (r *Ring) simulateScenario4() {
 			}
 		}
 	}
+	r.simulateLookups(100)
 
 	time.Sleep(20 * time.Second)
 	logrus.Infoln(r.PrintNodes())
@@ -174,12 +178,28 @@ func (r *Ring) simulateScenario4() {
 	return
 }
 
+/*
+	Looks up random keys while the ring has not stabilized yet, and logs how
+	many of the lookups verification had to correct.
+*/
+func (r *Ring) simulateLookups(count int) {
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%d", rand.Int()))
+		if _, err := r.Lookup(1, key); err != nil {
+			logrus.Errorln("lookup failed:", err.Error())
+		}
+	}
+	stats := r.LookupStats()
+	logrus.Infof("Lookups verified %d corrected %d unverified %d", stats.Verified, stats.Corrected, stats.Unverified)
+}
+
 func createRing(nN int) (*Ring, error) {
 	config := DefaultConfig("local")
 	config.StabilizeMin = 5 * time.Second
 	config.StabilizeMax = 10 * time.Second
 	config.NumSuccessors = 3
 	config.NumVnodes = nN
+	config.VerifyLookups = true
 
 	ring, err := Create(config, nil)
 	if err != nil {
@@ -0,0 +1,178 @@
+package chord
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+type Percentiles struct {
+	/*
+		Summary of a set of samples
+		P50, P90, P99 (float64): The 50th, 90th and 99th percentile of the samples
+		Max (float64): The largest sample
+	*/
+	P50 float64
+	P90 float64
+	P99 float64
+	Max float64
+}
+
+type HistogramBucket struct {
+	/*
+		A single bucket of a histogram
+		UpperBound (float64): Samples less than or equal to this value fall in the bucket,
+			math.Inf(1) for the overflow bucket
+		Count (int): Number of samples in the bucket
+	*/
+	UpperBound float64
+	Count      int
+}
+
+/*
+	Computes the p50/p90/p99/max of the samples using the nearest-rank method.
+	An empty set of samples results in all zeroes.
+*/
+func computePercentiles(samples []float64) Percentiles {
+	if len(samples) == 0 {
+		return Percentiles{}
+	}
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	return Percentiles{
+		P50: nearestRank(sorted, 50),
+		P90: nearestRank(sorted, 90),
+		P99: nearestRank(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+// Returns the p-th percentile of an already sorted, non-empty slice
+func nearestRank(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+/*
+	Counts the samples into buckets with the given ascending upper bounds.
+	Samples above the last bound are counted in an extra overflow bucket.
+*/
+func computeHistogram(samples []float64, bounds []float64) []HistogramBucket {
+	buckets := make([]HistogramBucket, len(bounds)+1)
+	for i, bound := range bounds {
+		buckets[i].UpperBound = bound
+	}
+	buckets[len(bounds)].UpperBound = math.Inf(1)
+	for _, sample := range samples {
+		idx := sort.SearchFloat64s(bounds, sample)
+		buckets[idx].Count++
+	}
+	return buckets
+}
+
+/*
+	Returns exponentially growing bucket bounds for latencies, starting at 1µs and
+	doubling until the largest sample is covered.
+*/
+func latencyBounds(samples []float64) []float64 {
+	max := 0.0
+	for _, sample := range samples {
+		max = math.Max(max, sample)
+	}
+	var bounds []float64
+	for bound := float64(time.Microsecond); ; bound *= 2 {
+		bounds = append(bounds, bound)
+		if bound >= max {
+			break
+		}
+	}
+	return bounds
+}
+
+/*
+	Returns one bucket per integer value for small discrete samples such as
+	jump numbers, from 0 up to the largest sample.
+*/
+func unitBounds(samples []float64) []float64 {
+	max := 0.0
+	for _, sample := range samples {
+		max = math.Max(max, sample)
+	}
+	var bounds []float64
+	for bound := 0.0; bound <= max; bound++ {
+		bounds = append(bounds, bound)
+	}
+	return bounds
+}
+
+// Converts durations to float64 nanoseconds
+func durationSamples(durations []time.Duration) []float64 {
+	samples := make([]float64, len(durations))
+	for i, d := range durations {
+		samples[i] = float64(d)
+	}
+	return samples
+}
+
+// Returns the total of the durations
+func sumDurations(durations []time.Duration) time.Duration {
+	total := time.Duration(0)
+	for _, d := range durations {
+		total += d
+	}
+	return total
+}
+
+// Converts integer samples to float64
+func intSamples(values []int) []float64 {
+	samples := make([]float64, len(values))
+	for i, v := range values {
+		samples[i] = float64(v)
+	}
+	return samples
+}
+
+/*
+	Computes the Gini coefficient of the values, 0 for a perfectly even distribution
+	and approaching 1 as everything concentrates on a single value.
+*/
+func giniCoefficient(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	sum := 0.0
+	weighted := 0.0
+	for i, value := range sorted {
+		sum += value
+		weighted += float64(i+1) * value
+	}
+	if sum == 0 {
+		return 0
+	}
+	return 2*weighted/(float64(n)*sum) - float64(n+1)/float64(n)
+}
+
+// Returns the ratio of the largest value to the mean of the values
+func maxMeanRatio(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	max := 0.0
+	for _, value := range values {
+		sum += value
+		max = math.Max(max, value)
+	}
+	if sum == 0 {
+		return 0
+	}
+	return max / (sum / float64(len(values)))
+}
@@ -0,0 +1,186 @@
+package chord
+
+import (
+	"fmt"
+	"log"
+)
+
+// Implemented by transports that can ask a vnode to ping another on their behalf
+type IndirectPinger interface {
+	// Asks the via vnode to ping the target, returns whether the target answered
+	PingVia(via, target *Vnode) (bool, error)
+}
+
+// Suspicion state of a remote vnode, reported to the Delegate
+type SuspicionState int
+
+const (
+	VnodeAlive   SuspicionState = iota // Suspicion was refuted by an indirect probe
+	VnodeSuspect                       // A direct ping failed, indirect probes are under way
+	VnodeDead                          // Every probe failed, the vnode is evicted
+)
+
+func (s SuspicionState) String() string {
+	switch s {
+	case VnodeAlive:
+		return "alive"
+	case VnodeSuspect:
+		return "suspect"
+	case VnodeDead:
+		return "dead"
+	}
+	return fmt.Sprintf("SuspicionState(%d)", int(s))
+}
+
+// Implemented by delegates that want to know about suspected vnodes
+type SuspicionDelegate interface {
+	// The suspicion state of a remote vnode a local vnode probes changed
+	SuspicionChanged(local, remote *Vnode, state SuspicionState)
+}
+
+// Asks a local vnode to ping the target, or passes the request on
+func (lt *LocalTransport) PingVia(via, target *Vnode) (bool, error) {
+	// Look for it locally
+	_, ok := lt.get(via)
+
+	// If it exists locally, ping directly
+	if ok {
+		lt.stats.record(rpcPingVia, vnodeSize(via)+vnodeSize(target), 1)
+		lt.lock.RLock()
+		known := knownHost(lt.local, target.Host)
+		lt.lock.RUnlock()
+		if !known {
+			return false, fmt.Errorf("%w Host %s is not a neighbour", ErrInvalidRequest, target.Host)
+		}
+		return lt.Ping(target)
+	}
+
+	// Pass onto remote
+	if remote, ok := lt.remote.(IndirectPinger); ok {
+		return remote.PingVia(via, target)
+	}
+	return false, fmt.Errorf("Transport cannot ping indirectly")
+}
+
+// Asks a remote vnode to ping the target
+func (t *TCPTransport) PingVia(via, target *Vnode) (bool, error) {
+	body, err := t.call(via.Host, tcpPingViaReq, &tcpBodyTwoVnode{Target: via, Vn: target})
+	if err != nil {
+		return false, err
+	}
+	resp, ok := body.(*tcpBodyBoolError)
+	if !ok {
+		return false, unexpectedResponse(tcpPingViaReq, body)
+	}
+	if resp.Err != nil {
+		return false, resp.Err
+	}
+	return resp.B, nil
+}
+
+// Checks whether a neighbour is alive, SWIM style. If it fails the direct
+// check, up to IndirectProbes other known vnodes on different hosts are asked
+// to ping it, and it is only declared dead if all of them fail too. The
+// delegate is told when the vnode becomes suspect and how that is resolved.
+func (vn *localVnode) probe(target *Vnode) (bool, error) {
+	alive, err := vn.ring.isAlive(target)
+	if alive {
+		return true, err
+	}
+	pinger, ok := vn.ring.transport.(IndirectPinger)
+	helpers := vn.indirectHelpers(target, vn.ring.config.IndirectProbes)
+	if !ok || len(helpers) == 0 {
+		if err == nil {
+			vn.ring.cache.evict(target)
+		}
+		return alive, err
+	}
+
+	vn.suspicionChanged(target, VnodeSuspect)
+	results := make(chan bool, len(helpers))
+	for _, via := range helpers {
+		go func(via *Vnode) {
+			ok, err := pinger.PingVia(via, target)
+			if err != nil {
+				log.Printf("[ERR] Indirect ping of %s via %s failed! Got %s", target.String(), via.String(), err)
+			}
+			results <- ok
+		}(via)
+	}
+	for range helpers {
+		if <-results {
+			vn.suspicionChanged(target, VnodeAlive)
+			return true, nil
+		}
+	}
+	// Confirmed dead, so the caller evicts it even if the direct ping errored
+	vn.suspicionChanged(target, VnodeDead)
+	vn.ring.cache.evict(target)
+	return false, nil
+}
+
+// Returns whether the host runs the predecessor, a successor or a finger of
+// the vnode
+func (vn *localVnode) knowsHost(host string) bool {
+	if vn.predecessor != nil && vn.predecessor.Host == host {
+		return true
+	}
+	for _, s := range vn.successors {
+		if s != nil && s.Host == host {
+			return true
+		}
+	}
+	for _, f := range vn.finger {
+		if f != nil && f.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether any of the registered vnodes knows the host. Only such hosts
+// are pinged for others, so PingVia cannot be used to probe arbitrary hosts.
+// The caller must hold the lock of the registrations.
+func knownHost(local map[string]*localRPC, host string) bool {
+	for _, w := range local {
+		if vn, ok := w.obj.(*localVnode); ok && vn.knowsHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks up to k known vnodes to probe the target through. Each is on a
+// different host, and neither on ours nor on the host of the target, so the
+// probes take other network paths.
+func (vn *localVnode) indirectHelpers(target *Vnode, k int) []*Vnode {
+	if k <= 0 {
+		return nil
+	}
+	hosts := map[string]bool{vn.Host: true, target.Host: true}
+	helpers := make([]*Vnode, 0, k)
+	candidates := append(append([]*Vnode{vn.predecessor}, vn.successors...), vn.finger...)
+	for _, c := range candidates {
+		if len(helpers) == k {
+			break
+		}
+		if c == nil || hosts[c.Host] {
+			continue
+		}
+		hosts[c.Host] = true
+		helpers = append(helpers, c)
+	}
+	return helpers
+}
+
+// Reports a change in the suspicion state of a remote vnode to the delegate,
+// if it listens
+func (vn *localVnode) suspicionChanged(remote *Vnode, state SuspicionState) {
+	d, ok := vn.ring.config.Delegate.(SuspicionDelegate)
+	if !ok {
+		return
+	}
+	vn.ring.invokeDelegate(func() {
+		d.SuspicionChanged(&vn.Vnode, remote, state)
+	})
+}
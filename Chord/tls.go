@@ -0,0 +1,74 @@
+package chord
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Configures TLS with mutual certificate verification for the TCP transport.
+// Both sides present the certificate and verify the peer against the CA.
+type TLSConfig struct {
+	CertFile string // PEM encoded certificate presented to peers
+	KeyFile  string // PEM encoded private key of the certificate
+	CAFile   string // PEM encoded CA certificates peers are verified against
+}
+
+// Loads the certificates and builds the server and client side configurations
+func (c *TLSConfig) load() (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load TLS key pair! Got %s", err)
+	}
+	caPEM, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read TLS CA file! Got %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("No certificates found in TLS CA file %s", c.CAFile)
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
+
+// Creates a new TCP transport on the given listen address with the configured
+// timeout duration, which only talks to peers over mutually authenticated TLS.
+func InitTLSTransport(listen string, timeout time.Duration, conf *TLSConfig) (*TCPTransport, error) {
+	server, client, err := conf.load()
+	if err != nil {
+		return nil, err
+	}
+	return initTCPTransport(listen, timeout, server, client)
+}
+
+// Wraps an outbound connection in TLS and performs the handshake, verifying
+// the certificate of the host against the CA
+func (t *TCPTransport) clientTLS(conn net.Conn, host string) (net.Conn, error) {
+	conf := t.tlsClient.Clone()
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName = host
+	}
+	conf.ServerName = serverName
+	tlsConn := tls.Client(conn, conf)
+	tlsConn.SetDeadline(time.Now().Add(t.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
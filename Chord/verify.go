@@ -0,0 +1,102 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+)
+
+// Implemented by transports that can check the host a remote vnode advertises
+// against the identity of the peer that sent it
+type VnodeHostVerifier interface {
+	// Enables rejecting requests whose sending vnode advertises a host that
+	// the certificate of the peer is not valid for
+	SetVerifyVnodeHosts(enabled bool)
+}
+
+// Checks that the ID of a remote vnode is the hash of its advertised host and
+// index. Always true when verification is disabled.
+func (r *Ring) validVnode(vn *Vnode) bool {
+	if !r.config.VerifyIds || vn == nil {
+		return true
+	}
+	if vn.Num < 0 || vn.Num > 0xffff {
+		return false
+	}
+	return bytes.Equal(vn.Id, genVnodeId(r.config.HashFunc, vn.Host, uint16(vn.Num)))
+}
+
+// Returns an error wrapping ErrInvalidVnode if the vnode fails verification
+func (r *Ring) verifyVnode(vn *Vnode) error {
+	if r.validVnode(vn) {
+		return nil
+	}
+	log.Printf("[ERR] Rejected vnode %s! ID does not match host %s and index %d", vn.String(), vn.Host, vn.Num)
+	return fmt.Errorf("%w Vnode %s claims host %s and index %d", ErrInvalidVnode, vn.String(), vn.Host, vn.Num)
+}
+
+// Drops the vnodes that fail verification, keeping the order of the rest
+func (r *Ring) filterVnodes(vns []*Vnode) []*Vnode {
+	if !r.config.VerifyIds {
+		return vns
+	}
+	res := make([]*Vnode, 0, len(vns))
+	for _, vn := range vns {
+		if r.verifyVnode(vn) == nil {
+			res = append(res, vn)
+		}
+	}
+	return res
+}
+
+// Sets whether the TCP transport checks sending vnodes against peer certificates
+func (t *TCPTransport) SetVerifyVnodeHosts(enabled bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.verifyHosts = enabled
+}
+
+// Returns the certificate the peer of a TLS connection presented, nil for plaintext
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// Checks that the vnode a request was sent on behalf of advertises a host the
+// certificate of the peer is valid for. Requests without a sender always pass.
+func (t *TCPTransport) verifySender(cert *x509.Certificate, reqType int, body wireMessage) error {
+	t.lock.RLock()
+	enabled := t.verifyHosts
+	t.lock.RUnlock()
+	if !enabled || cert == nil {
+		return nil
+	}
+
+	var sender *Vnode
+	switch reqType {
+	case tcpNotifyReq, tcpClearPredReq, tcpSkipSucReq:
+		sender = body.(*tcpBodyTwoVnode).Vn
+	}
+	if sender == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(sender.Host)
+	if err != nil {
+		host = sender.Host
+	}
+	if err := cert.VerifyHostname(host); err != nil {
+		return fmt.Errorf("%w Vnode %s claims host %s, peer certificate is for %s",
+			ErrInvalidVnode, sender.String(), sender.Host, cert.Subject.CommonName)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package chord
+
+import (
+	"bytes"
+	"correct-chord-go/global"
+	"log"
+	"sync/atomic"
+)
+
+// Outcome counters of verified lookups
+type LookupStats struct {
+	Verified   uint64 // Lookups whose owner confirmed it holds the key
+	Corrected  uint64 // Lookups whose stale owner was replaced by walking the successor lists
+	Unverified uint64 // Lookups whose owner could not be confirmed, returned as found
+}
+
+// Thread safe LookupStats
+type lookupCounters struct {
+	verified   uint64
+	corrected  uint64
+	unverified uint64
+}
+
+// Returns a copy of the counters
+func (c *lookupCounters) snapshot() LookupStats {
+	return LookupStats{
+		Verified:   atomic.LoadUint64(&c.verified),
+		Corrected:  atomic.LoadUint64(&c.corrected),
+		Unverified: atomic.LoadUint64(&c.unverified),
+	}
+}
+
+// Returns the counters accumulated since an earlier snapshot
+func (s LookupStats) since(prev LookupStats) LookupStats {
+	return LookupStats{
+		Verified:   s.Verified - prev.Verified,
+		Corrected:  s.Corrected - prev.Corrected,
+		Unverified: s.Unverified - prev.Unverified,
+	}
+}
+
+/*
+	Confirms that the first of up to k successors of a key owns it, by asking
+	it for its predecessor and checking that the key falls in (pred, owner].
+	A lookup routed through stale fingers or successor lists while the ring
+	is unstable can end on the wrong vnode, which is corrected as follows:
+		- The owner does not respond: the next successor is tried.
+		- Its predecessor lies between the key and the owner: a vnode joined
+			in between, and the predecessor is checked next.
+		- The key lies beyond the owner: the owner routes the key again, its
+			successor list usually holds the real owner.
+	Returns the successors, and whether they were corrected and confirmed.
+	An owner that does not know its predecessor yet cannot be confirmed.
+*/
+func (r *Ring) verifyLookup(k int, key []byte, succs []*Vnode) ([]*Vnode, bool, bool) {
+	corrected := false
+	for tries := 0; len(succs) > 0 && tries <= r.config.NumSuccessors; tries++ {
+		owner := succs[0]
+		pred, err := r.transport.GetPredecessor(owner)
+		if err != nil {
+			log.Printf("[ERR] Failed to verify owner %s. Got %s", owner.String(), err)
+			succs = succs[1:]
+			corrected = true
+			continue
+		}
+		if pred == nil {
+			return succs, corrected, false
+		}
+		if (IDRange{Start: pred.Id, End: owner.Id}).Contains(key) {
+			return succs, corrected, true
+		}
+		corrected = true
+
+		// A vnode joined between the key and the owner
+		if global.Between(key, owner.Id, pred.Id) {
+			succs = append([]*Vnode{pred}, succs...)
+			if len(succs) > k {
+				succs = succs[:k]
+			}
+			continue
+		}
+
+		// The owner precedes the key, let it route the key again
+		next, _, _, err := r.transport.FindSuccessors(owner, k, key)
+		if err != nil || len(next) == 0 || next[0] == nil || bytes.Equal(next[0].Id, owner.Id) {
+			succs = succs[1:]
+			continue
+		}
+		for len(next) > 0 && next[len(next)-1] == nil {
+			next = next[:len(next)-1]
+		}
+		succs = next
+	}
+	return succs, corrected, false
+}
+
+// Verifies the result of a lookup if enabled, updating the counters and
+// dropping the cached owner of a corrected key. Returns the successors and
+// whether they were corrected.
+func (r *Ring) checkLookup(k int, key []byte, succs []*Vnode) ([]*Vnode, bool) {
+	if !r.config.VerifyLookups {
+		return succs, false
+	}
+	res, corrected, confirmed := r.verifyLookup(k, key, succs)
+	if len(res) == 0 {
+		// Nothing better was found
+		atomic.AddUint64(&r.lookups.unverified, 1)
+		return succs, false
+	}
+	if corrected {
+		atomic.AddUint64(&r.lookups.corrected, 1)
+		r.cache.invalidate(key)
+	}
+	if confirmed {
+		atomic.AddUint64(&r.lookups.verified, 1)
+	} else {
+		atomic.AddUint64(&r.lookups.unverified, 1)
+	}
+	return res, corrected
+}
+
+// Returns the outcome counters of verified lookups
+func (r *Ring) LookupStats() LookupStats {
+	return r.lookups.snapshot()
+}
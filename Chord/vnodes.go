@@ -0,0 +1,159 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Largest vnode index, the index is hashed into the ID as 16 bits
+const maxVnodeIndex = 0xffff
+
+/*
+	Adds a local vnode at runtime, so a host can grow its capacity without
+	restarting. The vnode takes the lowest free index, joins the ring through
+	the nearest local vnode with a full successor list, and stabilizes from
+	then on like the other vnodes. Returns the new vnode.
+*/
+func (r *Ring) AddVnode() (*Vnode, error) {
+	r.resizeLock.Lock()
+	defer r.resizeLock.Unlock()
+	r.lock.RLock()
+	vnodes, shutdown := r.vnodes, r.shutdown != nil
+	r.lock.RUnlock()
+	if shutdown {
+		return nil, fmt.Errorf("Ring is shutting down!")
+	}
+	if len(vnodes) == 0 {
+		return nil, fmt.Errorf("No local vnode to join through!")
+	}
+
+	// Take the lowest free index
+	used := make(map[int]bool, len(vnodes))
+	for _, vn := range vnodes {
+		used[vn.Num] = true
+	}
+	idx := 0
+	for used[idx] {
+		idx++
+	}
+	if idx > maxVnodeIndex {
+		return nil, fmt.Errorf("Host has %d vnodes, the most supported", maxVnodeIndex+1)
+	}
+
+	// Join without holding the lock, lookups go on meanwhile
+	vn := &localVnode{}
+	vn.ring = r
+	vn.init(idx)
+	if _, err := vn.joinNew(joinOrigin(vnodes, vn.Id)); err != nil {
+		r.transport.Deregister(&vn.Vnode)
+		return nil, err
+	}
+	r.cache.joined(&vn.Vnode)
+
+	r.lock.Lock()
+	if r.shutdown != nil {
+		r.lock.Unlock()
+		vn.fail()
+		return nil, fmt.Errorf("Ring is shutting down!")
+	}
+	r.vnodes = withVnode(r.vnodes, vn)
+	r.lock.Unlock()
+	vn.schedule(make(chan bool))
+	return &vn.Vnode, nil
+}
+
+/*
+	Removes a local vnode at runtime, so a host can shrink its capacity
+	without restarting. A graceful removal tells the predecessor and successor
+	to skip the vnode, as Leave does for every vnode, otherwise the vnode just
+	stops answering and the ring notices it failed. The last local vnode
+	cannot be removed, use Leave or Shutdown instead.
+*/
+func (r *Ring) RemoveVnode(v *Vnode, graceful bool) error {
+	r.resizeLock.Lock()
+	defer r.resizeLock.Unlock()
+	r.lock.Lock()
+	idx := -1
+	for i, vn := range r.vnodes {
+		if bytes.Equal(vn.Id, v.Id) {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		r.lock.Unlock()
+		return fmt.Errorf("%w Vnode %s", ErrVnodeNotFound, v.String())
+	}
+	if len(r.vnodes) == 1 {
+		r.lock.Unlock()
+		return fmt.Errorf("Cannot remove the last local vnode!")
+	}
+
+	// Stop stabilizing along with the count Shutdown waits for
+	vn := r.vnodes[idx]
+	vn.stop()
+	r.vnodes = withoutVnode(r.vnodes, idx)
+	r.lock.Unlock()
+
+	if graceful {
+		return vn.leave()
+	}
+	return vn.fail()
+}
+
+// Stops the vnode from stabilizing. A stabilize that is already running
+// finishes, but does not schedule another one.
+func (vn *localVnode) stop() {
+	atomic.StoreInt32(&vn.stopped, 1)
+	vn.timerLock.Lock()
+	defer vn.timerLock.Unlock()
+	if vn.timer != nil {
+		vn.timer.Stop()
+	}
+}
+
+// Returns whether the vnode was stopped
+func (vn *localVnode) isStopped() bool {
+	return atomic.LoadInt32(&vn.stopped) == 1
+}
+
+// Returns the nearest vnode preceding the key that has a full successor list,
+// so a new vnode joining through it starts with a full list too. Falls back
+// to the nearest vnode if none has.
+func joinOrigin(vnodes []*localVnode, key []byte) *localVnode {
+	nearest := nearestIn(vnodes, key)
+	idx := 0
+	for i, vn := range vnodes {
+		if vn == nearest {
+			idx = i
+		}
+	}
+	for i := 0; i < len(vnodes); i++ {
+		vn := vnodes[(idx-i+len(vnodes))%len(vnodes)]
+		if !vn.Shutdown && vn.knownSuccessors() == len(vn.successors) {
+			return vn
+		}
+	}
+	return nearest
+}
+
+// Returns a sorted copy of the vnodes with the vnode added. Readers use the
+// slice without holding the lock, so it is never changed in place.
+func withVnode(vnodes []*localVnode, vn *localVnode) []*localVnode {
+	res := make([]*localVnode, 0, len(vnodes)+1)
+	res = append(res, vnodes...)
+	res = append(res, vn)
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Id, res[j].Id) == -1
+	})
+	return res
+}
+
+// Returns a copy of the vnodes without the vnode at the index
+func withoutVnode(vnodes []*localVnode, idx int) []*localVnode {
+	res := make([]*localVnode, 0, len(vnodes)-1)
+	res = append(res, vnodes[:idx]...)
+	return append(res, vnodes[idx+1:]...)
+}
@@ -0,0 +1,126 @@
+package chord
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Vnode count a host is moving towards after a change of its weight
+type vnodeWeight struct {
+	lock      sync.Mutex
+	step      sync.Mutex // Held while a vnode is added or drained
+	perWeight int        // Vnodes of a host of weight 1, Config.NumVnodes is left as given
+	target    int        // Vnodes the host should run
+	running   bool       // Vnodes are being added or drained
+	stopped   bool       // The ring is shutting down, no more vnodes are changed
+}
+
+// Returns the number of vnodes of a host with the given weight, at least one.
+// A weight of 0 counts as 1.
+func weightedVnodes(perWeight int, weight float64) int {
+	if weight == 0 {
+		weight = 1
+	}
+	n := int(math.Round(float64(perWeight) * weight))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+/*
+	Changes the capacity weight of the host at runtime. The host moves to the
+	vnode count of the new weight gradually, adding or gracefully draining one
+	vnode every StabilizeMax, so the ring stabilizes around each change before
+	the next one. Drained vnodes are the ones with the highest index, so the
+	vnodes of a host keep the same IDs across weight changes.
+*/
+func (r *Ring) SetWeight(weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("Invalid weight %v", weight)
+	}
+	target := weightedVnodes(r.weight.perWeight, weight)
+	if target > maxVnodeIndex+1 {
+		return fmt.Errorf("Weight %v needs %d vnodes, at most %d are supported", weight, target, maxVnodeIndex+1)
+	}
+
+	r.weight.lock.Lock()
+	defer r.weight.lock.Unlock()
+	if r.weight.stopped {
+		return fmt.Errorf("Ring is shutting down!")
+	}
+	r.lock.Lock()
+	r.config.Weight = weight
+	r.lock.Unlock()
+	r.weight.target = target
+	if !r.weight.running {
+		r.weight.running = true
+		go r.rebalanceVnodes()
+	}
+	return nil
+}
+
+// Returns the capacity weight of the host, and the number of vnodes it runs
+// and is moving towards
+func (r *Ring) Weight() (float64, int, int) {
+	r.weight.lock.Lock()
+	defer r.weight.lock.Unlock()
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	weight := r.config.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return weight, len(r.vnodes), r.weight.target
+}
+
+// Adds or drains one vnode per StabilizeMax until the host runs the target
+// number of vnodes. The vnode is changed without holding the weight lock, so
+// SetWeight and Weight do not wait for the join or leave messages.
+func (r *Ring) rebalanceVnodes() {
+	for {
+		time.Sleep(r.config.StabilizeMax)
+		r.weight.step.Lock()
+		r.weight.lock.Lock()
+		vnodes := r.localVnodes()
+		current := len(vnodes)
+		var last *Vnode
+		for _, vn := range vnodes {
+			if last == nil || vn.Num > last.Num {
+				last = &vn.Vnode
+			}
+		}
+		if r.weight.stopped || current == r.weight.target {
+			r.weight.running = false
+			r.weight.lock.Unlock()
+			r.weight.step.Unlock()
+			return
+		}
+		grow := current < r.weight.target
+		r.weight.lock.Unlock()
+
+		var err error
+		if grow {
+			_, err = r.AddVnode()
+		} else {
+			err = r.RemoveVnode(last, true)
+		}
+		if err != nil {
+			log.Printf("[ERR] Failed to change the number of vnodes. Got %s", err)
+		}
+		r.weight.step.Unlock()
+	}
+}
+
+// Stops changing the number of vnodes, waiting for a change in progress
+func (r *Ring) stopRebalance() {
+	r.weight.lock.Lock()
+	r.weight.stopped = true
+	r.weight.lock.Unlock()
+
+	r.weight.step.Lock()
+	r.weight.step.Unlock()
+}
@@ -0,0 +1,427 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+The TCP wire format is a language neutral, length prefixed binary framing. It is
+described in full in the "TCP Wire Protocol" section of the README; in short:
+
+	hello    = magic "CHRD" | uint16 min version | uint16 max version   (client -> server)
+	welcome  = magic "CHRD" | uint16 chosen version, 0 if none          (server -> client)
+	nonce    = 16 random bytes                  (both directions, from version 7)
+	frame    = uint32 length | uint8 type | uint64 request ID | payload
+	payload  = bytes ring ID | bytes body | bytes HMAC                 (from version 3)
+
+All integers are big endian. The length counts everything after itself. Responses
+use the type of their request with the high bit set, and echo its request ID.
+*/
+
+// Version of the wire protocol spoken by this build, and the oldest it still accepts.
+// Version 2 added error codes to error fields, version 3 sealed every payload in
+// an envelope carrying the ring ID and an HMAC, version 4 added PingVia,
+// version 5 ClosestPreceding, version 6 FindSuccessorsBatch and version 7 bound
+// the HMAC to nonces exchanged by the handshake.
+const (
+	tcpProtocolVersion    = 7
+	tcpMinProtocolVersion = 1
+)
+
+// First version whose error fields carry an error code
+const tcpErrorCodeVersion = 2
+
+// First version whose payloads are sealed with the ring identity
+const tcpIdentityVersion = 3
+
+// First version that knows the PingVia request
+const tcpPingViaVersion = 4
+
+// First version that knows the ClosestPreceding request
+const tcpClosestPrecedingVersion = 5
+
+// First version that knows the FindSuccessorsBatch request
+const tcpBatchVersion = 6
+
+// First version whose handshake exchanges the session nonces
+const tcpNonceVersion = 7
+
+// Marks the start of a handshake
+var tcpMagic = []byte("CHRD")
+
+// Set on the type of a frame carrying a response
+const tcpRespFlag = 0x80
+
+// Largest frame that will be read, protects against corrupt length prefixes
+const tcpMaxFrameSize = 16 << 20
+
+// A message with an explicit binary schema
+type wireMessage interface {
+	encode(w *wireWriter)
+	decode(r *wireReader)
+}
+
+// Builds a payload from primitive fields for the given protocol version
+type wireWriter struct {
+	buf     bytes.Buffer
+	version uint16
+}
+
+func (w *wireWriter) putUint8(v uint8) {
+	w.buf.WriteByte(v)
+}
+
+func (w *wireWriter) putUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *wireWriter) putInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.buf.Write(b[:])
+}
+
+func (w *wireWriter) putBool(v bool) {
+	if v {
+		w.putUint8(1)
+	} else {
+		w.putUint8(0)
+	}
+}
+
+// bytes: uint32 length | data
+func (w *wireWriter) putBytes(v []byte) {
+	w.putUint32(uint32(len(v)))
+	w.buf.Write(v)
+}
+
+// string: uint32 length | UTF-8 data
+func (w *wireWriter) putString(v string) {
+	w.putBytes([]byte(v))
+}
+
+// vnode: uint8 present | int64 num | bytes id | string host
+func (w *wireWriter) putVnode(vn *Vnode) {
+	if vn == nil {
+		w.putBool(false)
+		return
+	}
+	w.putBool(true)
+	w.putInt64(int64(vn.Num))
+	w.putBytes(vn.Id)
+	w.putString(vn.Host)
+}
+
+// vnode list: uint32 count | vnode...
+func (w *wireWriter) putVnodes(vns []*Vnode) {
+	w.putUint32(uint32(len(vns)))
+	for _, vn := range vns {
+		w.putVnode(vn)
+	}
+}
+
+// key list: uint32 count | bytes...
+func (w *wireWriter) putKeys(keys [][]byte) {
+	w.putUint32(uint32(len(keys)))
+	for _, key := range keys {
+		w.putBytes(key)
+	}
+}
+
+// list of vnode lists: uint32 count | vnode list...
+func (w *wireWriter) putVnodeLists(lists [][]*Vnode) {
+	w.putUint32(uint32(len(lists)))
+	for _, vns := range lists {
+		w.putVnodes(vns)
+	}
+}
+
+// error: uint8 code | string message, code 0 for no error.
+// Before version 2 only the message is sent, empty for no error.
+func (w *wireWriter) putError(err error) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	if w.version >= tcpErrorCodeVersion {
+		w.putUint8(errorCode(err))
+	}
+	w.putString(msg)
+}
+
+// Reads primitive fields from a payload of the given protocol version. The
+// first error is sticky and all further reads return zero values.
+type wireReader struct {
+	data    []byte
+	version uint16
+	err     error
+}
+
+func (r *wireReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *wireReader) getUint8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *wireReader) getUint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *wireReader) getInt64() int64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *wireReader) getBool() bool {
+	return r.getUint8() != 0
+}
+
+func (r *wireReader) getBytes() []byte {
+	n := r.getUint32()
+	b := r.take(int(n))
+	if b == nil {
+		return nil
+	}
+	res := make([]byte, len(b))
+	copy(res, b)
+	return res
+}
+
+func (r *wireReader) getString() string {
+	return string(r.getBytes())
+}
+
+func (r *wireReader) getVnode() *Vnode {
+	if !r.getBool() {
+		return nil
+	}
+	vn := &Vnode{}
+	vn.Num = int(r.getInt64())
+	vn.Id = r.getBytes()
+	vn.Host = r.getString()
+	return vn
+}
+
+func (r *wireReader) getVnodes() []*Vnode {
+	n := r.getUint32()
+	if r.err != nil {
+		return nil
+	}
+	// Every vnode takes at least one byte, guard against bogus counts
+	if int(n) > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	// Empty lists are sent for nil ones, decode them as nil
+	if n == 0 {
+		return nil
+	}
+	vns := make([]*Vnode, 0, n)
+	for i := uint32(0); i < n; i++ {
+		vns = append(vns, r.getVnode())
+	}
+	return vns
+}
+
+func (r *wireReader) getKeys() [][]byte {
+	n := r.getUint32()
+	if r.err != nil {
+		return nil
+	}
+	// Every key takes at least four bytes, guard against bogus counts
+	if int(n) > len(r.data)/4 {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	keys := make([][]byte, 0, n)
+	for i := uint32(0); i < n; i++ {
+		keys = append(keys, r.getBytes())
+	}
+	return keys
+}
+
+func (r *wireReader) getVnodeLists() [][]*Vnode {
+	n := r.getUint32()
+	if r.err != nil {
+		return nil
+	}
+	// Every list takes at least four bytes, guard against bogus counts
+	if int(n) > len(r.data)/4 {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	lists := make([][]*Vnode, 0, n)
+	for i := uint32(0); i < n; i++ {
+		lists = append(lists, r.getVnodes())
+	}
+	return lists
+}
+
+func (r *wireReader) getError() error {
+	if r.version >= tcpErrorCodeVersion {
+		code := r.getUint8()
+		return decodeError(code, r.getString())
+	}
+	msg := r.getString()
+	if msg == "" {
+		return nil
+	}
+	return decodeError(errCodeUnknown, msg)
+}
+
+// Encodes a message into a payload
+func encodeMessage(msg wireMessage, version uint16) []byte {
+	w := &wireWriter{version: version}
+	msg.encode(w)
+	return w.buf.Bytes()
+}
+
+// Decodes a payload into a message, the whole payload must be consumed
+func decodeMessage(payload []byte, msg wireMessage, version uint16) error {
+	r := &wireReader{data: payload, version: version}
+	msg.decode(r)
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return fmt.Errorf("%d trailing bytes in message", len(r.data))
+	}
+	return nil
+}
+
+// Writes a single frame, returns the number of bytes written
+func writeFrame(w io.Writer, msgType uint8, reqID uint64, payload []byte) (int, error) {
+	frame := make([]byte, 4+1+8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(1+8+len(payload)))
+	frame[4] = msgType
+	binary.BigEndian.PutUint64(frame[5:13], reqID)
+	copy(frame[13:], payload)
+	return w.Write(frame)
+}
+
+// Reads a single frame, returns its type, request ID, payload and total size
+func readFrame(r io.Reader) (uint8, uint64, []byte, int, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, 0, nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length < 1+8 || length > tcpMaxFrameSize {
+		return 0, 0, nil, 0, fmt.Errorf("Invalid frame length %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, 0, nil, 0, err
+	}
+	return frame[0], binary.BigEndian.Uint64(frame[1:9]), frame[9:], 4 + int(length), nil
+}
+
+// Sends the client side of the handshake
+func writeHello(w io.Writer) error {
+	hello := make([]byte, 8)
+	copy(hello, tcpMagic)
+	binary.BigEndian.PutUint16(hello[4:6], tcpMinProtocolVersion)
+	binary.BigEndian.PutUint16(hello[6:8], tcpProtocolVersion)
+	_, err := w.Write(hello)
+	return err
+}
+
+// Reads the client side of the handshake, returns the range of versions it speaks
+func readHello(r io.Reader) (uint16, uint16, error) {
+	hello := make([]byte, 8)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(hello[:4], tcpMagic) {
+		return 0, 0, fmt.Errorf("Invalid handshake magic %q", hello[:4])
+	}
+	return binary.BigEndian.Uint16(hello[4:6]), binary.BigEndian.Uint16(hello[6:8]), nil
+}
+
+// Picks the highest version both sides speak, 0 if there is none
+func negotiateVersion(min, max uint16) uint16 {
+	version := max
+	if version > tcpProtocolVersion {
+		version = tcpProtocolVersion
+	}
+	if version < min || version < tcpMinProtocolVersion {
+		return 0
+	}
+	return version
+}
+
+// Sends the server side of the handshake
+func writeWelcome(w io.Writer, version uint16) error {
+	welcome := make([]byte, 6)
+	copy(welcome, tcpMagic)
+	binary.BigEndian.PutUint16(welcome[4:6], version)
+	_, err := w.Write(welcome)
+	return err
+}
+
+// Reads the server side of the handshake, returns the chosen version
+func readWelcome(r io.Reader) (uint16, error) {
+	welcome := make([]byte, 6)
+	if _, err := io.ReadFull(r, welcome); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(welcome[:4], tcpMagic) {
+		return 0, fmt.Errorf("Invalid handshake magic %q", welcome[:4])
+	}
+	version := binary.BigEndian.Uint16(welcome[4:6])
+	if version == 0 {
+		return 0, fmt.Errorf("%w We speak %d to %d", ErrProtocolMismatch,
+			tcpMinProtocolVersion, tcpProtocolVersion)
+	}
+	return version, nil
+}
+
+// Exchanges the random nonces both sides contribute to the session nonce,
+// returns the session nonce: client nonce | server nonce
+func exchangeNonces(w io.Writer, r io.Reader, server bool) ([]byte, error) {
+	local, err := newSessionNonce()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(local); err != nil {
+		return nil, err
+	}
+	remote := make([]byte, sessionNonceSize)
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, err
+	}
+	if server {
+		return append(remote, local...), nil
+	}
+	return append(local, remote...), nil
+}
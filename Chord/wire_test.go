@@ -0,0 +1,218 @@
+package chord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+var (
+	wireVnodeA = &Vnode{Id: []byte{1, 2, 3}, Host: "10.0.0.1:8000", Num: 1}
+	wireVnodeB = &Vnode{Id: []byte{4, 5, 6}, Host: "10.0.0.2:8000", Num: 65535}
+)
+
+// A message of every schema, without errors, and an empty one to decode into
+var wireMessages = []struct {
+	name  string
+	msg   wireMessage
+	empty func() wireMessage
+}{
+	{"Error", &tcpBodyError{}, func() wireMessage { return &tcpBodyError{} }},
+	{"String", &tcpBodyString{S: "10.0.0.1:8000"}, func() wireMessage { return &tcpBodyString{} }},
+	{"Vnode", &tcpBodyVnode{Vn: wireVnodeA}, func() wireMessage { return &tcpBodyVnode{} }},
+	{"AbsentVnode", &tcpBodyVnode{}, func() wireMessage { return &tcpBodyVnode{} }},
+	{"TwoVnode", &tcpBodyTwoVnode{Target: wireVnodeA, Vn: wireVnodeB}, func() wireMessage { return &tcpBodyTwoVnode{} }},
+	{"FindSuc", &tcpBodyFindSuc{Target: wireVnodeA, Num: 3, Key: []byte{9, 9}}, func() wireMessage { return &tcpBodyFindSuc{} }},
+	{"FindSucBatch", &tcpBodyFindSucBatch{Target: wireVnodeA, Num: 2, Keys: [][]byte{{1}, {2, 3}}},
+		func() wireMessage { return &tcpBodyFindSucBatch{} }},
+	{"VnodeError", &tcpBodyVnodeError{Vnode: wireVnodeB}, func() wireMessage { return &tcpBodyVnodeError{} }},
+	{"VnodeListError", &tcpBodyVnodeListError{Vnodes: []*Vnode{wireVnodeA, nil, wireVnodeB}},
+		func() wireMessage { return &tcpBodyVnodeListError{} }},
+	{"TwoVnodeListError", &tcpBodyTwoVnodeListError{Vnodes: []*Vnode{wireVnodeA}, Next: []*Vnode{wireVnodeB}},
+		func() wireMessage { return &tcpBodyTwoVnodeListError{} }},
+	{"VnodeListsError", &tcpBodyVnodeListsError{Lists: [][]*Vnode{{wireVnodeA}, nil, {wireVnodeB, wireVnodeA}}},
+		func() wireMessage { return &tcpBodyVnodeListsError{} }},
+	{"BoolError", &tcpBodyBoolError{B: true}, func() wireMessage { return &tcpBodyBoolError{} }},
+}
+
+func TestWireMessageRoundTrip(t *testing.T) {
+	for _, version := range []uint16{tcpMinProtocolVersion, tcpProtocolVersion} {
+		for _, tc := range wireMessages {
+			payload := encodeMessage(tc.msg, version)
+			out := tc.empty()
+			if err := decodeMessage(payload, out, version); err != nil {
+				t.Fatalf("%s v%d: failed to decode. Got %s", tc.name, version, err)
+			}
+			if !reflect.DeepEqual(out, tc.msg) {
+				t.Fatalf("%s v%d: expected %+v. Got %+v", tc.name, version, tc.msg, out)
+			}
+		}
+	}
+}
+
+func TestWireErrorRoundTrip(t *testing.T) {
+	for code, sentinel := range errorsByCode {
+		sent := fmt.Errorf("%w Vnode 1", sentinel)
+		payload := encodeMessage(&tcpBodyError{Err: sent}, tcpProtocolVersion)
+		out := &tcpBodyError{}
+		if err := decodeMessage(payload, out, tcpProtocolVersion); err != nil {
+			t.Fatalf("Code %d: failed to decode. Got %s", code, err)
+		}
+		if !errors.Is(out.Err, sentinel) || out.Err.Error() != sent.Error() {
+			t.Fatalf("Code %d: expected %q matching its sentinel. Got %v", code, sent, out.Err)
+		}
+	}
+
+	// Version 1 only carries the message
+	payload := encodeMessage(&tcpBodyError{Err: ErrTimeout}, tcpMinProtocolVersion)
+	out := &tcpBodyError{}
+	if err := decodeMessage(payload, out, tcpMinProtocolVersion); err != nil {
+		t.Fatalf("Failed to decode. Got %s", err)
+	}
+	if out.Err == nil || out.Err.Error() != ErrTimeout.Error() || errors.Is(out.Err, ErrTimeout) {
+		t.Fatalf("Expected only the message of the error. Got %v", out.Err)
+	}
+}
+
+func TestWireEmptyListsDecodeAsNil(t *testing.T) {
+	for _, vnodes := range [][]*Vnode{nil, {}} {
+		payload := encodeMessage(&tcpBodyTwoVnodeListError{Vnodes: vnodes, Next: []*Vnode{wireVnodeA}}, tcpProtocolVersion)
+		out := &tcpBodyTwoVnodeListError{}
+		if err := decodeMessage(payload, out, tcpProtocolVersion); err != nil {
+			t.Fatalf("Failed to decode. Got %s", err)
+		}
+		if out.Vnodes != nil || len(out.Next) != 1 {
+			t.Fatalf("Expected a nil list and one candidate. Got %#v and %d", out.Vnodes, len(out.Next))
+		}
+	}
+
+	payload := encodeMessage(&tcpBodyVnodeListsError{Lists: [][]*Vnode{}}, tcpProtocolVersion)
+	out := &tcpBodyVnodeListsError{}
+	if err := decodeMessage(payload, out, tcpProtocolVersion); err != nil {
+		t.Fatalf("Failed to decode. Got %s", err)
+	}
+	if out.Lists != nil {
+		t.Fatalf("Expected nil lists. Got %#v", out.Lists)
+	}
+}
+
+func TestWireTruncatedMessages(t *testing.T) {
+	for _, tc := range wireMessages {
+		payload := encodeMessage(tc.msg, tcpProtocolVersion)
+		for n := 0; n < len(payload); n++ {
+			if err := decodeMessage(payload[:n], tc.empty(), tcpProtocolVersion); err == nil {
+				t.Fatalf("%s: expected %d of %d bytes to fail", tc.name, n, len(payload))
+			}
+		}
+
+		// Trailing bytes are rejected too
+		if err := decodeMessage(append(payload, 0), tc.empty(), tcpProtocolVersion); err == nil {
+			t.Fatalf("%s: expected a trailing byte to fail", tc.name)
+		}
+	}
+}
+
+func TestWireBogusCounts(t *testing.T) {
+	huge := make([]byte, 4)
+	binary.BigEndian.PutUint32(huge, 0xffffffff)
+	noError := []byte{errCodeNone, 0, 0, 0, 0}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		msg     wireMessage
+	}{
+		{"VnodeList", append(append([]byte{}, huge...), noError...), &tcpBodyVnodeListError{}},
+		{"VnodeLists", append(append([]byte{}, huge...), noError...), &tcpBodyVnodeListsError{}},
+		{"Keys", append([]byte{0, 0, 0, 0, 1}, huge...), &tcpBodyFindSucBatch{}},
+		{"String", huge, &tcpBodyString{}},
+	}
+	for _, tc := range tests {
+		if err := decodeMessage(tc.payload, tc.msg, tcpProtocolVersion); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: expected %s. Got %v", tc.name, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestWireFrames(t *testing.T) {
+	var buf bytes.Buffer
+	payload := encodeMessage(&tcpBodyVnode{Vn: wireVnodeA}, tcpProtocolVersion)
+	size, err := writeFrame(&buf, tcpPing, 42, payload)
+	if err != nil {
+		t.Fatalf("Failed to write frame. Got %s", err)
+	}
+	frame := append([]byte{}, buf.Bytes()...)
+
+	msgType, reqID, got, read, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read frame. Got %s", err)
+	}
+	if msgType != tcpPing || reqID != 42 || !bytes.Equal(got, payload) || read != size {
+		t.Fatalf("Frame did not round trip. Got type %d, ID %d, %d bytes", msgType, reqID, read)
+	}
+
+	// Truncated frames
+	for n := 0; n < len(frame); n++ {
+		if _, _, _, _, err := readFrame(bytes.NewReader(frame[:n])); err == nil {
+			t.Fatalf("Expected %d of %d bytes to fail", n, len(frame))
+		}
+	}
+
+	// Lengths too short for the header, or over the limit
+	for _, length := range []uint32{0, 8, tcpMaxFrameSize + 1} {
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, length)
+		if _, _, _, _, err := readFrame(bytes.NewReader(append(prefix, make([]byte, 16)...))); err == nil {
+			t.Fatalf("Expected a frame length of %d to fail", length)
+		}
+	}
+}
+
+func TestWireHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeHello(&buf); err != nil {
+		t.Fatalf("Failed to write hello. Got %s", err)
+	}
+	min, max, err := readHello(&buf)
+	if err != nil || min != tcpMinProtocolVersion || max != tcpProtocolVersion {
+		t.Fatalf("Hello did not round trip. Got %d-%d, %v", min, max, err)
+	}
+	if v := negotiateVersion(min, max+3); v != tcpProtocolVersion {
+		t.Fatalf("Expected version %d. Got %d", tcpProtocolVersion, v)
+	}
+	if v := negotiateVersion(tcpProtocolVersion+1, tcpProtocolVersion+2); v != 0 {
+		t.Fatalf("Expected no common version. Got %d", v)
+	}
+	if _, _, err := readHello(bytes.NewReader([]byte("HTTP/1.1"))); err == nil {
+		t.Fatalf("Expected a foreign magic to fail")
+	}
+}
+
+func TestReadResponsesRejectsMismatchedType(t *testing.T) {
+	// A GetPredecessor response to a Ping
+	var buf bytes.Buffer
+	payload := encodeMessage(&tcpBodyVnodeError{Vnode: wireVnodeA}, tcpMinProtocolVersion)
+	writeFrame(&buf, tcpGetPredReq|tcpRespFlag, 1, payload)
+
+	sock, peer := net.Pipe()
+	defer peer.Close()
+	out := &tcpOutConn{sock: sock, reader: bufio.NewReader(&buf), version: tcpMinProtocolVersion,
+		pending: make(map[uint64]*tcpPending)}
+	p := &tcpPending{reqType: tcpPing, done: make(chan tcpResult, 1)}
+	if _, err := out.register(p); err != nil {
+		t.Fatalf("Failed to register request. Got %s", err)
+	}
+
+	trans := &TCPTransport{pool: make(map[string][]*tcpOutConn)}
+	trans.readResponses(out)
+	res := <-p.done
+	if res.err == nil || res.body != nil {
+		t.Fatalf("Expected the mismatched response to fail the request. Got %+v", res.body)
+	}
+}
@@ -8,16 +8,19 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
 
 	/*
-		This is the entry point of the project. 4 modes are possible, which is described in detail later on.
+		This is the entry point of the project. 6 modes are possible, which is described in detail later on.
 		1. DHT
 		2. Simulation
 		3. Correctness Testing
 		4. Performance Testing
+		5. Churn Testing
+		6. Load Distribution Analysis
 	 */
 
 	arguments := os.Args[1:]
@@ -26,7 +29,8 @@ func main() {
 		caseRunning = "dht"
 	} else {
 		caseRunning = arguments[0]
-		if caseRunning != "dht" && caseRunning != "correctness" && caseRunning != "simulation" && caseRunning != "performance" {
+		if caseRunning != "dht" && caseRunning != "correctness" && caseRunning != "simulation" && caseRunning != "performance" && caseRunning != "churn" &&
+			caseRunning != "distribution" {
 			fmt.Println("Unknown argument for the case to run.")
 			return
 		}
@@ -98,18 +102,45 @@ func main() {
 			- Logs generated show the sequence of events, final ring state, and the invariants that were violated in the run.
 
 		4. Performance (performance)
-		   Input: [mode="performance", numNodes, numRuns, NumQueries, querySteps, NumQuerySteps]
-		   Output: [cpuPerformance.csv, queryPerformance.csv]
+		   Input: [mode="performance", numNodes, numRuns, NumQueries, querySteps, NumQuerySteps, (origin), (lookupMode),
+		   (maxRTT), (cacheSize), (verifyLookups)]
+		   Output: [cpuPerformance.csv, queryPerformance.csv, originPerformance.csv, rpcPerformance.csv,
+		   (proximityPerformance.csv)]
 		   Performance will be evaluated on the following metrics:
 		   a. CPU Time: The time taken by the ring to stabilize.
 		   b. Average Jump Number: The mean length of the paths followed to retrieve a particular node.
 		   c. Average Finger Table Lookup: The average number of lookups made in the finger table of each node.
 		   d. Query Performance: The time taken to execute the queries GET, SET, and DELETE.
+		   e. Message Overhead: The number of RPCs and bytes sent per vnode per second, for each RPC type.
+		   With lookupMode "both", recursive and iterative lookups are compared on the same queries.
+		   With maxRTT (in milliseconds), the vnodes are placed on an emulated network and the latency of the
+		   queries over exact successor fingers is compared with proximity fingers.
+		   With cacheSize, lookups are answered from a location cache of that many ranges where they can be, and
+		   its hits, misses, hit rate and evictions are reported per batch.
+		   With verifyLookups "verify", the owner of every lookup is confirmed, and the verified, corrected and
+		   unverified lookups are reported per batch.
 
 		   Each run generates a number of objects that store logs such as CPU time, total elapsed time, etc.
 		   At the end of the run, a STATS() (name not final) function consolidates the information generated and
 		   presents it as tables.
 
+		5. Churn (churn)
+		   Input: [mode="churn", version, numNodes, numSuccessors, numEvents, EventFireDelay, QueryInterval,
+		   QueriesPerInterval]
+		   Output: [churnPerformance.csv, churn_logs.txt]
+		   - Fires random JOIN, LEAVE and FAILURE events like the correctness mode while a query workload runs.
+		   - Every result is verified against the owner computed from the live nodes.
+		   - Reports lookup success rate, wrong owner rate and lookup latency for each query interval.
+
+		6. Distribution (distribution)
+		   Input: [mode="distribution", numHosts, numVnodes, numKeys, vnodeSteps, numVnodeSteps, (keyPattern), (weights)]
+		   Output: [loadDistribution.csv, hostLoad.csv]
+		   - Hashes a workload of keys onto rings generated with the same vnode ID scheme as the DHT.
+		   - Computes the ownership share of every vnode and host, the Gini coefficient and max/mean ratio.
+		   - Hosts get vnodes in proportion to their weights, comma separated and repeated over the hosts,
+		     and their ownership share is reported against their share of the total weight.
+		   - Sweeps the number of vnodes per host to show the load balance curve.
+
 	*/
 	if caseRunning == "dht" {
 		for {
@@ -275,9 +306,43 @@ func main() {
 		nQ, _ := strconv.Atoi(arguments[3])
 		qS, _ := strconv.Atoi(arguments[4])
 		nQS, _ := strconv.Atoi(arguments[5])
+		var origin *int
+		if len(arguments) > 6 && arguments[6] != "random" {
+			num, err := strconv.Atoi(arguments[6])
+			if err != nil {
+				fmt.Println("Not a valid origin:", arguments[6])
+				return
+			}
+			origin = &num
+		}
+		modes := []chord.LookupMode{chord.RecursiveLookup}
+		if len(arguments) > 7 {
+			if arguments[7] == "both" {
+				modes = []chord.LookupMode{chord.RecursiveLookup, chord.IterativeLookup}
+			} else {
+				mode, err := chord.ParseLookupMode(arguments[7])
+				if err != nil {
+					fmt.Println(err.Error())
+					return
+				}
+				modes = []chord.LookupMode{mode}
+			}
+		}
+		maxRTT := 0
+		if len(arguments) > 8 {
+			maxRTT, _ = strconv.Atoi(arguments[8])
+		}
+		cacheSize := 0
+		if len(arguments) > 9 {
+			cacheSize, _ = strconv.Atoi(arguments[9])
+		}
+		verifyLookups := len(arguments) > 10 && arguments[10] == "verify"
 
 		config := chord.DefaultConfig("local")
 		config.NumVnodes = nN
+		config.LocationCacheSize = cacheSize
+		config.VerifyLookups = verifyLookups
+		start := time.Now()
 		ring, err := chord.Create(config, nil)
 		if err != nil {
 			fmt.Println("error in creating ring:", err.Error())
@@ -289,11 +354,104 @@ func main() {
 			NumQueries:    nQ,
 			QuerySteps:    qS,
 			NumQuerySteps: nQS,
+			Origin:        origin,
+			Modes:         modes,
+			MaxRTT:        time.Duration(maxRTT) * time.Millisecond,
+		}
+		if err := ring.TestPerformance(params); err != nil {
+			fmt.Println(err.Error())
+			return
 		}
-		ring.TestPerformance(params)
 		logrus.Infoln(chord.QueryPerformanceMetrics)
 		logrus.Infoln(chord.CPUPerformanceMetrics)
 		chord.LogStats(n, nN)
+		chord.LogRPCStats(ring.RPCStats(), nN, time.Since(start))
+		chord.LogBreakerStats(ring.BreakerStats())
+		if maxRTT > 0 {
+			chord.LogProximityStats()
+		}
 		logrus.Infoln(ring.PrintNodes())
+	} else if caseRunning == "churn" {
+		filename := "churn_logs.txt"
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0755)
+		if err != nil {
+			fmt.Println("Couldn't open file, got: ", err.Error())
+			return
+		}
+		formatter := &logrus.TextFormatter{
+			DisableQuoteFields: true,
+			DisableKeyFields:   true,
+		}
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(f)
+		chord.InitPerformance()
+		version := arguments[1]
+		if version != "new" && version != "old" {
+			fmt.Println("Not a valid version to test churn for")
+			return
+		}
+		nN, _ := strconv.Atoi(arguments[2])
+		numSuccessors, _ := strconv.Atoi(arguments[3])
+		nE, _ := strconv.Atoi(arguments[4])
+		eFD, _ := strconv.Atoi(arguments[5])
+		qI, _ := strconv.Atoi(arguments[6])
+		qPI, _ := strconv.Atoi(arguments[7])
+
+		config := chord.DefaultConfig("local")
+		config.NumVnodes = nN
+		config.NumSuccessors = numSuccessors
+		ring, err := chord.Create(config, nil)
+		if err != nil {
+			fmt.Println("error in creating ring:", err.Error())
+			return
+		}
+
+		params := chord.ChurnParams{
+			Version:            version,
+			NumEvents:          nE,
+			EventFireDelay:     time.Duration(eFD) * time.Second,
+			QueryInterval:      time.Duration(qI) * time.Second,
+			QueriesPerInterval: qPI,
+		}
+		ring.TestChurn(params)
+		chord.LogChurn()
+	} else if caseRunning == "distribution" {
+		chord.InitPerformance()
+		nH, _ := strconv.Atoi(arguments[1])
+		nV, _ := strconv.Atoi(arguments[2])
+		nK, _ := strconv.Atoi(arguments[3])
+		vS, _ := strconv.Atoi(arguments[4])
+		nVS, _ := strconv.Atoi(arguments[5])
+		keyPattern := "random"
+		if len(arguments) > 6 {
+			keyPattern = arguments[6]
+		}
+		if keyPattern != "random" && keyPattern != "sequential" {
+			fmt.Println("Not a valid key pattern")
+			return
+		}
+		var weights []float64
+		if len(arguments) > 7 {
+			for _, w := range strings.Split(arguments[7], ",") {
+				weight, err := strconv.ParseFloat(w, 64)
+				if err != nil || weight <= 0 {
+					fmt.Println("Not a valid weight:", w)
+					return
+				}
+				weights = append(weights, weight)
+			}
+		}
+
+		params := chord.DistributionParams{
+			NumHosts:      nH,
+			NumVnodes:     nV,
+			NumKeys:       nK,
+			KeyPattern:    keyPattern,
+			VnodeSteps:    vS,
+			NumVnodeSteps: nVS,
+			Weights:       weights,
+		}
+		chord.TestDistribution(params, config.HashFunc)
+		chord.LogDistribution()
 	}
 }